@@ -1,6 +1,6 @@
 // aggregator
 
-// fetches data from collectors and inserts into MongoDB
+// fetches data from collectors and inserts into MongoDB and/or files, see sinks.go
 
 /*
  *  architecture:
@@ -19,9 +19,10 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"github.com/BurntSushi/toml"
 	"github.com/holgerBerger/go_ludalo/lustreserver"
-	"gopkg.in/mgo.v2"
+	"github.com/holgerBerger/go_ludalo/sink"
 	"gopkg.in/mgo.v2/bson"
 	"log"
 	"net/rpc"
@@ -37,7 +38,11 @@ import (
 type configT struct {
 	Collector  collectorConfig
 	Database   databaseConfig
+	Sinks      []sinkConfig `toml:"sink"`
+	Spool      spoolConfig
+	Rollup     rollupConfig
 	Nidmapping nidmappingConfig
+	TLS        lustreserver.TLSConfig
 }
 
 type collectorConfig struct {
@@ -45,15 +50,42 @@ type collectorConfig struct {
 	MDS                []string
 	LocalcollectorPath string
 	CollectorPath      string
+	CollectorConfig    string
 	MaxEntries         int
 	Port               int
 	Interval           int
 	SnapInterval       int
+	Mode               string
+	CapacityInterval   int
+	HealthInterval     int
 }
 
 type databaseConfig struct {
 	Server string
 	Name   string
+	Layout string
+}
+
+// a sink for the data, if none is configured, mongo is used
+type sinkConfig struct {
+	Type    string // mongo (with settings of database) or file
+	Dir     string // file: directory for the files
+	MaxSize int    // file: MB per file, 0 is unlimited
+	MaxAge  int    // file: secs per file, 0 is unlimited
+}
+
+// spool for samples which could not be written to mongo, empty dir for none
+type spoolConfig struct {
+	Dir     string
+	MaxSize int // MB, 0 is unlimited
+	Retry   int // secs between attempts to replay
+}
+
+// rollups into tiers and retention, see rollup.go
+type rollupConfig struct {
+	Tiers         []string       // of 1m, 1h and 1d
+	PurgeInterval int            // secs between purges
+	Retention     map[string]int // days to keep for each tier, raw, jobstats, brwstats and capacity, 0 or missing is forever
 }
 
 type nidmappingConfig struct {
@@ -74,6 +106,8 @@ type hostfile struct {
 var (
 	conf    configT
 	hostmap hostfile
+	// TLS for connections to collectors, nil for plain RPC
+	clientTLS *tls.Config
 )
 
 // global variables for timing
@@ -165,7 +199,16 @@ func spawnCollector(c string) {
 
 		log.Println("starting collector on " + c)
 		count++
-		out, err := exec.Command("ssh", c, conf.Collector.CollectorPath).CombinedOutput()
+		// port is passed to collector, so both sides agree on it
+		args := []string{c, conf.Collector.CollectorPath, "--port", strconv.Itoa(conf.Collector.Port)}
+		// in buffered mode collector samples on its own, with our interval
+		if conf.Collector.Mode == "buffered" {
+			args = append(args, "--sample-interval", strconv.Itoa(conf.Collector.Interval))
+		}
+		if conf.Collector.CollectorConfig != "" {
+			args = append(args, "--config", conf.Collector.CollectorConfig)
+		}
+		out, err := exec.Command("ssh", args...).CombinedOutput()
 		if err != nil {
 			log.Println("error: unexpected end on " + c)
 			log.Println(string(out))
@@ -182,18 +225,50 @@ func spawnCollector(c string) {
 	}
 }
 
+// get health of collector of server, log it and keep it for RPC server
+func checkHealth(server string, client *rpc.Client) error {
+	var health lustreserver.Health
+	err := client.Call("ServerRpcT.Health", 0, &health)
+	if err != nil {
+		return err
+	}
+	log.Printf("health of %s: build %s %s, up %ds, lustre %s, ost %v, mdt %v, read errors %d, mem %d MB",
+		server, health.BuildID, health.Hash, health.Uptime, health.LustreVersion, health.IsOST, health.IsMDT,
+		health.ReadErrors, health.MemSys/(1024*1024))
+	if health.IsOST {
+		log.Printf("health of %s: ost scan %d targets %d exports in %.2f secs, incomplete %v", server,
+			health.OstScan.Targets, health.OstScan.Exports, health.OstScan.Duration, health.OstScan.Incomplete)
+	}
+	if health.IsMDT {
+		log.Printf("health of %s: mdt scan %d targets %d exports in %.2f secs, incomplete %v", server,
+			health.MdtScan.Targets, health.MdtScan.Exports, health.MdtScan.Duration, health.MdtScan.Incomplete)
+	}
+
+	dataLock.Lock()
+	HealthData[server] = health
+	dataLock.Unlock()
+	return nil
+}
+
 // collect OSS data from collectors, and push them into channel
 // towards database inserter. The channel is buffered,
 // to limit amount of RAM used
-// we take time here, as this avoid problems with non-synchronous clocks
+// in poll mode we take time here, as this avoid problems with non-synchronous clocks
 // on servers and allows snapping to a certain intervals
-func ossCollect(server string, signal chan int, inserter chan lustreserver.OstValues) {
-	var replyOSS lustreserver.OstValues
+func ossCollect(server string, signal chan int, inserter chan lustreserver.OstValues, jobInserter chan lustreserver.OstJobValues,
+	brwInserter chan lustreserver.BrwValues, capInserter chan lustreserver.CapacityValues) {
+	var diffSession int64
+	// in buffered mode, start time of sampler of collector and last sample we got
+	var epoch, lastSeq int64
+	buffered := conf.Collector.Mode == "buffered"
+	// capacity changes slowly, it is fetched every CapacityInterval seconds only,
+	// health of collector every HealthInterval seconds
+	var lastCapacity, lastHealth time.Time
 
 	for {
 		// setup RPC
 		log.Print("connecting RPC to " + server + ":" + strconv.Itoa(conf.Collector.Port))
-		client, err := rpc.Dial("tcp", server+":"+strconv.Itoa(conf.Collector.Port))
+		client, err := lustreserver.Dial(server+":"+strconv.Itoa(conf.Collector.Port), clientTLS)
 		if err != nil {
 			log.Print("dialing:", err)
 			time.Sleep(1 * time.Second)
@@ -201,12 +276,15 @@ func ossCollect(server string, signal chan int, inserter chan lustreserver.OstVa
 		}
 		log.Print("connected RPC to " + server + ":" + strconv.Itoa(conf.Collector.Port))
 
-		// init call for differences
-		err = client.Call("OssRpcT.GetValuesDiff", true, &replyOSS)
-		if err != nil {
-			log.Print("rpcerror:", err)
-			time.Sleep(1 * time.Second) // wait a sec
-			continue
+		// init call for differences, gives our own session in the collector,
+		// not needed in buffered mode, where the collector samples on its own
+		if !buffered {
+			err = client.Call("OssRpcT.InitDiff", 0, &diffSession)
+			if err != nil {
+				log.Print("rpcerror:", err)
+				time.Sleep(1 * time.Second) // wait a sec
+				continue
+			}
 		}
 
 		// loop endless as long as RPC works, otherwise exit and reconnect
@@ -216,9 +294,15 @@ func ossCollect(server string, signal chan int, inserter chan lustreserver.OstVa
 			t1 := time.Now()
 			// get timestamp and snap it to a configured interval, which allows more efficient
 			// DB access later
-			now := t1.Unix()
-			timestamp := (now / int64(conf.Collector.SnapInterval)) * int64(conf.Collector.SnapInterval)
-			err := client.Call("OssRpcT.GetValuesDiff", false, &replyOSS)
+			timestamp := snapTimestamp(t1.Unix())
+			var samples []lustreserver.OssSample
+			if buffered {
+				samples, err = pullOssSamples(server, client, &epoch, &lastSeq)
+			} else {
+				var sample lustreserver.OssSample
+				sample, err = pollOss(client, diffSession, timestamp)
+				samples = append(samples, sample)
+			}
 			if err != nil {
 				log.Print("rpc problems for server " + server)
 				log.Print("rpcerror:", err)
@@ -226,15 +310,53 @@ func ossCollect(server string, signal chan int, inserter chan lustreserver.OstVa
 				time.Sleep(1 * time.Second)
 				break
 			}
-			replyOSS.Timestamp = int32(timestamp)
+			var replyCapacity lustreserver.CapacityValues
+			getCapacity := t1.Sub(lastCapacity) >= time.Duration(conf.Collector.CapacityInterval)*time.Second
+			if getCapacity {
+				err = client.Call("OssRpcT.GetCapacity", 0, &replyCapacity)
+				if err != nil {
+					log.Print("rpc problems for server " + server)
+					log.Print("rpcerror:", err)
+					log.Print("trying to reconnect...")
+					time.Sleep(1 * time.Second)
+					break
+				}
+				replyCapacity.Timestamp = timestamp
+				lastCapacity = t1
+			}
+			if t1.Sub(lastHealth) >= time.Duration(conf.Collector.HealthInterval)*time.Second {
+				err = checkHealth(server, client)
+				if err != nil {
+					// older collectors do not know Health, so this is no reason to reconnect
+					log.Print("health rpcerror for server "+server+":", err)
+				}
+				lastHealth = t1
+			}
 			t2 := time.Now()
 			collectTimes[server] = float32(t2.Sub(t1).Seconds())
 
 			// copy data for RPC server
-			OssData[server] = replyOSS
+			dataLock.Lock()
+			if len(samples) > 0 {
+				OssData[server] = samples[len(samples)-1].Values
+			}
+			if getCapacity {
+				CapacityData[server] = replyCapacity
+			}
+			dataLock.Unlock()
 
 			// push data to mongo inserter
-			inserter <- replyOSS
+			for _, s := range samples {
+				if s.Values.Incomplete {
+					log.Println("WARNING: incomplete values from", server, "reading stats took too long")
+				}
+				inserter <- s.Values
+				jobInserter <- s.Jobs
+				brwInserter <- s.Brw
+			}
+			if getCapacity {
+				capInserter <- replyCapacity
+			}
 
 			t3 := time.Now()
 
@@ -251,15 +373,22 @@ func ossCollect(server string, signal chan int, inserter chan lustreserver.OstVa
 // collect MDS data from collectors, and push them into channel
 // towards database inserter. The channel is buffered,
 // to limit amount of RAM used
-// we take time here, as this avoid problems with non-synchronous clocks
+// in poll mode we take time here, as this avoid problems with non-synchronous clocks
 // on servers and allows snapping to a certain intervals
-func mdsCollect(server string, signal chan int, inserter chan lustreserver.MdsValues) {
-	var replyMDS lustreserver.MdsValues
+func mdsCollect(server string, signal chan int, inserter chan lustreserver.MdsValues, jobInserter chan lustreserver.MdsJobValues,
+	capInserter chan lustreserver.CapacityValues) {
+	var diffSession int64
+	// in buffered mode, start time of sampler of collector and last sample we got
+	var epoch, lastSeq int64
+	buffered := conf.Collector.Mode == "buffered"
+	// capacity changes slowly, it is fetched every CapacityInterval seconds only,
+	// health of collector every HealthInterval seconds
+	var lastCapacity, lastHealth time.Time
 
 	for {
 		// setup RPC
 		log.Print("connecting RPC to " + server + ":" + strconv.Itoa(conf.Collector.Port))
-		client, err := rpc.Dial("tcp", server+":"+strconv.Itoa(conf.Collector.Port))
+		client, err := lustreserver.Dial(server+":"+strconv.Itoa(conf.Collector.Port), clientTLS)
 		if err != nil {
 			log.Print("dialing:", err)
 			time.Sleep(1 * time.Second)
@@ -267,12 +396,15 @@ func mdsCollect(server string, signal chan int, inserter chan lustreserver.MdsVa
 		}
 		log.Print("connected RPC to " + server + ":" + strconv.Itoa(conf.Collector.Port))
 
-		// init call for differences
-		err = client.Call("MdsRpcT.GetValuesDiff", true, &replyMDS)
-		if err != nil {
-			log.Print("rpcerror:", err)
-			time.Sleep(1 * time.Second) // wait a sec
-			continue
+		// init call for differences, gives our own session in the collector,
+		// not needed in buffered mode, where the collector samples on its own
+		if !buffered {
+			err = client.Call("MdsRpcT.InitDiff", 0, &diffSession)
+			if err != nil {
+				log.Print("rpcerror:", err)
+				time.Sleep(1 * time.Second) // wait a sec
+				continue
+			}
 		}
 
 		// loop endless as long as RPC works, otherwise exit and reconnect
@@ -282,9 +414,15 @@ func mdsCollect(server string, signal chan int, inserter chan lustreserver.MdsVa
 			t1 := time.Now()
 			// get timestamp and snap it to a configured interval, which allows more efficient
 			// DB access later
-			now := t1.Unix()
-			timestamp := (now / int64(conf.Collector.SnapInterval)) * int64(conf.Collector.SnapInterval)
-			err := client.Call("MdsRpcT.GetValuesDiff", false, &replyMDS)
+			timestamp := snapTimestamp(t1.Unix())
+			var samples []lustreserver.MdsSample
+			if buffered {
+				samples, err = pullMdsSamples(server, client, &epoch, &lastSeq)
+			} else {
+				var sample lustreserver.MdsSample
+				sample, err = pollMds(client, diffSession, timestamp)
+				samples = append(samples, sample)
+			}
 			if err != nil {
 				log.Print("rpc problems for server " + server)
 				log.Print("rpcerror:", err)
@@ -292,11 +430,48 @@ func mdsCollect(server string, signal chan int, inserter chan lustreserver.MdsVa
 				time.Sleep(1 * time.Second)
 				break
 			}
-			replyMDS.Timestamp = int32(timestamp)
+			var replyCapacity lustreserver.CapacityValues
+			getCapacity := t1.Sub(lastCapacity) >= time.Duration(conf.Collector.CapacityInterval)*time.Second
+			if getCapacity {
+				err = client.Call("MdsRpcT.GetCapacity", 0, &replyCapacity)
+				if err != nil {
+					log.Print("rpc problems for server " + server)
+					log.Print("rpcerror:", err)
+					log.Print("trying to reconnect...")
+					time.Sleep(1 * time.Second)
+					break
+				}
+				replyCapacity.Timestamp = timestamp
+				lastCapacity = t1
+			}
+			if t1.Sub(lastHealth) >= time.Duration(conf.Collector.HealthInterval)*time.Second {
+				err = checkHealth(server, client)
+				if err != nil {
+					// older collectors do not know Health, so this is no reason to reconnect
+					log.Print("health rpcerror for server "+server+":", err)
+				}
+				lastHealth = t1
+			}
 			t2 := time.Now()
 			collectTimes[server] = float32(t2.Sub(t1).Seconds())
 
-			inserter <- replyMDS
+			// copy data for RPC server
+			if getCapacity {
+				dataLock.Lock()
+				CapacityData[server] = replyCapacity
+				dataLock.Unlock()
+			}
+
+			for _, s := range samples {
+				if s.Values.Incomplete {
+					log.Println("WARNING: incomplete values from", server, "reading stats took too long")
+				}
+				inserter <- s.Values
+				jobInserter <- s.Jobs
+			}
+			if getCapacity {
+				capInserter <- replyCapacity
+			}
 
 			t3 := time.Now()
 
@@ -310,15 +485,61 @@ func mdsCollect(server string, signal chan int, inserter chan lustreserver.MdsVa
 	}
 }
 
-// insert OSS data into MongoDB
-func ossInsert(server string, inserter chan lustreserver.OstValues, session *mgo.Session) {
-	// mongo session
-	db := session.DB(conf.Database.Name)
-	// cache for collections
-	collections := make(map[string]*mgo.Collection)
+// service times as stored in DB, average of the interval and maximum in usecs for each operation,
+// maximum only if it was reached in the interval
+func latencyDoc(times lustreserver.OpTimes) bson.M {
+	doc := bson.M{}
+	for op, t := range times {
+		if t.Max > 0 {
+			doc[op] = bson.M{"avg": float32(t.Avg()), "max": t.Max}
+		} else {
+			doc[op] = bson.M{"avg": float32(t.Avg())}
+		}
+	}
+	return doc
+}
+
+// NID name translation, splitting at @ + IP resolution in case of IP address
+func nidName(nid string) string {
+	nidname := strings.Split(nid, "@")[0]
+	// if it is IP address, map with rules from config e.g. to remove -ib postfix
+	if strings.ContainsAny(nidname, ".") {
+		nidname = hostmap.mapip2name(nidname)
+	}
+	return nidname
+}
+
+// document of OST values of a target or a nid, counters go into v as
+// array of exact counters instead of struct, other operations and
+// service times only if there were any
+func ostDoc(stats lustreserver.OstStats) bson.M {
+	doc := bson.M{"v": [4]int64{stats.WRqs, stats.WBs, stats.RRqs, stats.RBs}}
+	if len(stats.Ops) > 0 {
+		doc["ops"] = stats.Ops
+	}
+	if len(stats.Times) > 0 {
+		doc["lat"] = latencyDoc(stats.Times)
+	}
+	return doc
+}
 
-	var vals [4]float32
+// document of MDT values of a target or a nid, total number of requests
+// goes into v, operation mix into ops
+func mdtDoc(ops lustreserver.OpStats, times lustreserver.OpTimes) bson.M {
+	doc := bson.M{"v": int(ops.Total()), "ops": ops}
+	if len(times) > 0 {
+		doc["lat"] = latencyDoc(times)
+	}
+	return doc
+}
+
+// insert OSS data into MongoDB
+// flat layout has a document for each OST (nid aggr) and each of its nids,
+// compact layout has one document per OST, with its nids in list n
+// (a list, not a map, as nids can contain dots, which are not allowed in keys)
+func ossInsert(server string, inserter chan lustreserver.OstValues, out sink.Sink) {
 	var insertItems int32
+	rollups := newRollups()
 
 	for {
 		v := <-inserter
@@ -326,74 +547,64 @@ func ossInsert(server string, inserter chan lustreserver.OstValues, session *mgo
 		// fmt.Println(v)
 		insertItems = 0
 		t1 := time.Now()
+		docs := make(batch)
+		for _, r := range rollups {
+			r.start(int(v.Timestamp), docs)
+		}
 		for ost := range v.OstTotal {
 			// ost contains FS name in form FS-OST
 			names := strings.Split(ost, "-")
 			fsname := names[0]
 			ostname := names[1]
-			// we cache mongo collections here, not created each time
-			_, ok := collections[fsname]
-			if !ok {
-				collections[fsname] = db.C(fsname)
-			}
-			collection := collections[fsname]
-
-			// temp array to insert int array instead of struct
-			vals[0] = float32(v.OstTotal[ost].WRqs)
-			vals[1] = float32(v.OstTotal[ost].WBs)
-			vals[2] = float32(v.OstTotal[ost].RRqs)
-			vals[3] = float32(v.OstTotal[ost].RBs)
 
-			// insert aggregate data for OST
+			// aggregate data for OST
 			insertItems++
-			err := collection.Insert(bson.M{"ts": int(v.Timestamp),
-				"ost": ostname,
-				"nid": "aggr",
-				"v":   vals,
-				"dt":  v.Delta,
-			})
-			if err != nil {
-				log.Println("WARNING: insert error in ossInsert for", server)
-				log.Println(err)
-				session.Refresh()
+			doc := ostDoc(v.OstTotal[ost])
+			for _, r := range rollups {
+				r.addOst(fsname, ostname, "aggr", int(v.Timestamp), v.Delta, v.OstTotal[ost])
+			}
+			doc["ts"] = int(v.Timestamp)
+			doc["ost"] = ostname
+			doc["dt"] = v.Delta
+			// mark samples where counters were reset, e.g. by a failover
+			if v.Reset[ost] {
+				doc["reset"] = true
+			}
+			// mark samples where collector could not read all nids in time
+			if v.Incomplete {
+				doc["incomplete"] = true
 			}
 
+			nids := []bson.M{}
 			for nid := range v.NidValues[ost] {
-				// temp array to insert int array instead of struct
-				vals[0] = float32(v.NidValues[ost][nid].WRqs)
-				vals[1] = float32(v.NidValues[ost][nid].WBs)
-				vals[2] = float32(v.NidValues[ost][nid].RRqs)
-				vals[3] = float32(v.NidValues[ost][nid].RBs)
-
-				// NID name translation, splitting at @ + IP resolution in case of IP address
-				nidname := strings.Split(nid, "@")[0]
-				// if it is IP address, map with rules from config e.g. to remove -ib postfix
-				if strings.ContainsAny(nidname, ".") {
-					nidname = hostmap.mapip2name(nidname)
-				}
-
 				insertItems++
-				err := collection.Insert(bson.M{"ts": int(v.Timestamp),
-					"ost": ostname,
-					"nid": nidname,
-					"v":   vals,
-					"dt":  v.Delta,
-				})
-				if err != nil {
-					log.Println("WARNING: insert error in ossInsert for", server)
-					log.Println(err)
-					session.Refresh()
+				niddoc := ostDoc(v.NidValues[ost][nid])
+				niddoc["nid"] = nidName(nid)
+				for _, r := range rollups {
+					r.addOst(fsname, ostname, niddoc["nid"].(string), int(v.Timestamp), v.Delta, v.NidValues[ost][nid])
 				}
+				if conf.Database.Layout == "compact" {
+					nids = append(nids, niddoc)
+				} else {
+					niddoc["ts"] = int(v.Timestamp)
+					niddoc["ost"] = ostname
+					niddoc["dt"] = v.Delta
+					docs.add(fsname, niddoc)
+				}
+			}
+
+			if conf.Database.Layout == "compact" {
+				doc["n"] = nids
+			} else {
+				doc["nid"] = "aggr"
 			}
+			docs.add(fsname, doc)
 		}
+		docs.write(server, "ossInsert", out)
 
 		// write latest timestamp into DB as marker for end of transaction, so client won't read incomplete data
-		_, ok := collections["latesttimestamp"]
-		if !ok {
-			collections["latesttimestamp"] = db.C("latesttimestamp")
-		}
-		_, err := collections["latesttimestamp"].Upsert(bson.M{"latestts": bson.M{"$exists": true}},
-			bson.M{"$set": bson.M{"latestts": int(v.Timestamp)}})
+		err := out.Upsert("latesttimestamp", bson.M{"latestts": bson.M{"$exists": true}},
+			bson.M{"latestts": int(v.Timestamp)})
 		if err != nil {
 			log.Println("WARNING: error in update of last timestamp")
 			log.Println(err)
@@ -407,15 +618,10 @@ func ossInsert(server string, inserter chan lustreserver.OstValues, session *mgo
 	}
 }
 
-// insert MDS data into MongoDB
-func mdsInsert(server string, inserter chan lustreserver.MdsValues, session *mgo.Session) {
-	// mongo session
-	db := session.DB(conf.Database.Name)
-	// cache for collections
-	collections := make(map[string]*mgo.Collection)
-
-	var vals int
+// insert MDS data into MongoDB, layouts like in ossInsert
+func mdsInsert(server string, inserter chan lustreserver.MdsValues, out sink.Sink) {
 	var insertItems int32
+	rollups := newRollups()
 
 	for {
 		v := <-inserter
@@ -423,59 +629,60 @@ func mdsInsert(server string, inserter chan lustreserver.MdsValues, session *mgo
 		// fmt.Println(v)
 		insertItems = 0
 		t1 := time.Now()
+		docs := make(batch)
+		for _, r := range rollups {
+			r.start(int(v.Timestamp), docs)
+		}
 		for mdt := range v.MdsTotal {
-			// mdt contains FS name in form FS-OST
+			// mdt contains FS name in form FS-MDT
 			names := strings.Split(mdt, "-")
 			fsname := names[0]
 			mdtname := names[1]
-			// we cache mongo collections here, not created each time
-			_, ok := collections[fsname]
-			if !ok {
-				collections[fsname] = db.C(fsname)
-			}
-			collection := collections[fsname]
-
-			// temp array to insert int array instead of struct
-			vals = int(v.MdsTotal[mdt])
 
-			// insert aggregate data for OST
+			// aggregate data for MDT
 			insertItems++
-			err := collection.Insert(bson.M{"ts": int(v.Timestamp),
-				"mdt": mdtname,
-				"nid": "aggr",
-				"v":   vals,
-				"dt":  v.Delta,
-			})
-			if err != nil {
-				log.Println("WARNING: insert error in mdsInsert for", server)
-				log.Println(err)
-				session.Refresh()
+			doc := mdtDoc(v.MdsTotal[mdt], v.TotalTimes[mdt])
+			for _, r := range rollups {
+				r.addMdt(fsname, mdtname, "aggr", int(v.Timestamp), v.Delta, v.MdsTotal[mdt])
+			}
+			doc["ts"] = int(v.Timestamp)
+			doc["mdt"] = mdtname
+			doc["dt"] = v.Delta
+			// mark samples where counters were reset, e.g. by a failover
+			if v.Reset[mdt] {
+				doc["reset"] = true
+			}
+			// mark samples where collector could not read all nids in time
+			if v.Incomplete {
+				doc["incomplete"] = true
 			}
-			for nid := range v.NidValues[mdt] {
-				// temp array to insert int array instead of struct
-				vals = int(v.NidValues[mdt][nid])
-
-				// NID name translation, splitting at @ + IP resolution in case of IP address
-				nidname := strings.Split(nid, "@")[0]
-				// if it is IP address, map with rules from config e.g. to remove -ib postfix
-				if strings.ContainsAny(nidname, ".") {
-					nidname = hostmap.mapip2name(nidname)
-				}
 
+			nids := []bson.M{}
+			for nid := range v.NidValues[mdt] {
 				insertItems++
-				err := collection.Insert(bson.M{"ts": int(v.Timestamp),
-					"mdt": mdtname,
-					"nid": nidname,
-					"v":   vals,
-					"dt":  v.Delta,
-				})
-				if err != nil {
-					log.Println("WARNING: insert error in mdsInsert for", server)
-					log.Println(err)
-					session.Refresh()
+				niddoc := mdtDoc(v.NidValues[mdt][nid], v.NidTimes[mdt][nid])
+				niddoc["nid"] = nidName(nid)
+				for _, r := range rollups {
+					r.addMdt(fsname, mdtname, niddoc["nid"].(string), int(v.Timestamp), v.Delta, v.NidValues[mdt][nid])
 				}
+				if conf.Database.Layout == "compact" {
+					nids = append(nids, niddoc)
+				} else {
+					niddoc["ts"] = int(v.Timestamp)
+					niddoc["mdt"] = mdtname
+					niddoc["dt"] = v.Delta
+					docs.add(fsname, niddoc)
+				}
+			}
+
+			if conf.Database.Layout == "compact" {
+				doc["n"] = nids
+			} else {
+				doc["nid"] = "aggr"
 			}
+			docs.add(fsname, doc)
 		}
+		docs.write(server, "mdsInsert", out)
 		t2 := time.Now()
 
 		insertTimes[server] = float32(t2.Sub(t1).Seconds())
@@ -484,12 +691,110 @@ func mdsInsert(server string, inserter chan lustreserver.MdsValues, session *mgo
 	}
 }
 
+// insert OSS job_stats data into MongoDB, into a jobstats collection per filesystem
+func ossJobInsert(server string, inserter chan lustreserver.OstJobValues, out sink.Sink) {
+	for {
+		v := <-inserter
+		docs := make(batch)
+		for ost := range v.JobValues {
+			// ost contains FS name in form FS-OST
+			names := strings.Split(ost, "-")
+			fsname := names[0]
+			ostname := names[1]
+
+			for job := range v.JobValues[ost] {
+				doc := ostDoc(v.JobValues[ost][job])
+				doc["ts"] = int(v.Timestamp)
+				doc["ost"] = ostname
+				doc["job"] = job
+				doc["dt"] = v.Delta
+				docs.add(fsname+"_jobstats", doc)
+			}
+		}
+		docs.write(server, "ossJobInsert", out)
+	}
+}
+
+// insert MDS job_stats data into MongoDB, into a jobstats collection per filesystem
+func mdsJobInsert(server string, inserter chan lustreserver.MdsJobValues, out sink.Sink) {
+	for {
+		v := <-inserter
+		docs := make(batch)
+		for mdt := range v.JobValues {
+			// mdt contains FS name in form FS-MDT
+			names := strings.Split(mdt, "-")
+			fsname := names[0]
+			mdtname := names[1]
+
+			for job := range v.JobValues[mdt] {
+				doc := mdtDoc(v.JobValues[mdt][job], nil)
+				doc["ts"] = int(v.Timestamp)
+				doc["mdt"] = mdtname
+				doc["job"] = job
+				doc["dt"] = v.Delta
+				docs.add(fsname+"_jobstats", doc)
+			}
+		}
+		docs.write(server, "mdsJobInsert", out)
+	}
+}
+
+// insert OST brw_stats histograms into MongoDB, into a brwstats collection per filesystem
+func brwInsert(server string, inserter chan lustreserver.BrwValues, out sink.Sink) {
+	for {
+		v := <-inserter
+		docs := make(batch)
+		for ost := range v.OstBrw {
+			// ost contains FS name in form FS-OST
+			names := strings.Split(ost, "-")
+			fsname := names[0]
+			ostname := names[1]
+
+			// histograms are stored as documents of buckets with read and write counts
+			docs.add(fsname+"_brwstats", bson.M{"ts": int(v.Timestamp),
+				"ost": ostname,
+				"h":   v.OstBrw[ost],
+				"dt":  v.Delta,
+			})
+		}
+		docs.write(server, "brwInsert", out)
+	}
+}
+
+// insert OST and MDT capacity into MongoDB, into a capacity collection per filesystem
+func capacityInsert(server string, inserter chan lustreserver.CapacityValues, out sink.Sink) {
+	for {
+		v := <-inserter
+		docs := make(batch)
+		for target, c := range v.Targets {
+			// target contains FS name in form FS-OST or FS-MDT
+			names := strings.Split(target, "-")
+			fsname := names[0]
+			targetname := names[1]
+
+			// key is ost or mdt, like in the performance collections
+			key := "ost"
+			if strings.HasPrefix(targetname, "MDT") {
+				key = "mdt"
+			}
+			docs.add(fsname+"_capacity", bson.M{"ts": int(v.Timestamp),
+				key:   targetname,
+				"kbt": c.KBytesTotal,
+				"kbf": c.KBytesFree,
+				"ft":  c.FilesTotal,
+				"ff":  c.FilesFree,
+			})
+		}
+		docs.write(server, "capacityInsert", out)
+	}
+}
+
 // starts go routines to
 //  - spawn the collectors
 //  - run the central clock
-//  - spawn the inserters for the mongo db
+//  - spawn the inserters writing to out
 //  - do this for mds and oss
-func aggrRun(session *mgo.Session) {
+func aggrRun(out sink.Sink) {
 
 	ossCollectors := conf.Collector.OSS
 	mdsCollectors := conf.Collector.MDS
@@ -516,6 +821,26 @@ func aggrRun(session *mgo.Session) {
 	for i := range mdsInserters {
 		mdsInserters[i] = make(chan lustreserver.MdsValues, conf.Collector.MaxEntries)
 	}
+	ossJobInserters := make([]chan lustreserver.OstJobValues, len(ossCollectors))
+	for i := range ossJobInserters {
+		ossJobInserters[i] = make(chan lustreserver.OstJobValues, conf.Collector.MaxEntries)
+	}
+	mdsJobInserters := make([]chan lustreserver.MdsJobValues, len(mdsCollectors))
+	for i := range mdsJobInserters {
+		mdsJobInserters[i] = make(chan lustreserver.MdsJobValues, conf.Collector.MaxEntries)
+	}
+	brwInserters := make([]chan lustreserver.BrwValues, len(ossCollectors))
+	for i := range brwInserters {
+		brwInserters[i] = make(chan lustreserver.BrwValues, conf.Collector.MaxEntries)
+	}
+	ossCapInserters := make([]chan lustreserver.CapacityValues, len(ossCollectors))
+	for i := range ossCapInserters {
+		ossCapInserters[i] = make(chan lustreserver.CapacityValues, conf.Collector.MaxEntries)
+	}
+	mdsCapInserters := make([]chan lustreserver.CapacityValues, len(mdsCollectors))
+	for i := range mdsCapInserters {
+		mdsCapInserters[i] = make(chan lustreserver.CapacityValues, conf.Collector.MaxEntries)
+	}
 
 	// create channels to signal to collectors
 	// a blocking channel is used
@@ -542,23 +867,36 @@ func aggrRun(session *mgo.Session) {
 	// FIXME might need tuning? is 5 sec enough?
 	time.Sleep(5 * time.Second)
 
-	// create inserters to push data into mongodb
-	// using Copy of session (may be Clone is better? would reuse socket)
-	// changed to Clone()
+	// create inserters to push data into the sinks
+	for i, c := range ossCollectors {
+		go ossInsert(c, ossInserters[i], out)
+	}
+	for i, c := range mdsCollectors {
+		go mdsInsert(c, mdsInserters[i], out)
+	}
+	for i, c := range ossCollectors {
+		go ossJobInsert(c, ossJobInserters[i], out)
+	}
+	for i, c := range mdsCollectors {
+		go mdsJobInsert(c, mdsJobInserters[i], out)
+	}
 	for i, c := range ossCollectors {
-		go ossInsert(c, ossInserters[i], session.Clone())
+		go brwInsert(c, brwInserters[i], out)
+	}
+	for i, c := range ossCollectors {
+		go capacityInsert(c, ossCapInserters[i], out)
 	}
 	for i, c := range mdsCollectors {
-		go mdsInsert(c, mdsInserters[i], session.Clone())
+		go capacityInsert(c, mdsCapInserters[i], out)
 	}
 
 	// create collect goroutines to collect data and push it down the channels
 	// towards inserters
 	for i, c := range ossCollectors {
-		go ossCollect(c, ready[c], ossInserters[i])
+		go ossCollect(c, ready[c], ossInserters[i], ossJobInserters[i], brwInserters[i], ossCapInserters[i])
 	}
 	for i, c := range mdsCollectors {
-		go mdsCollect(c, ready[c], mdsInserters[i])
+		go mdsCollect(c, ready[c], mdsInserters[i], mdsJobInserters[i], mdsCapInserters[i])
 	}
 
 	/////////////////////////////////////////////////////////////////////////
@@ -580,6 +918,7 @@ func aggrRun(session *mgo.Session) {
 				ready[m] <- 1
 			default:
 				// skip this one, it is busy, channel is probably filled or RPC is stuck
+				log.Println("WARNING: skipping busy collector", m)
 			}
 		}
 		// oss last, as oss writes the timestamps into DB
@@ -589,6 +928,7 @@ func aggrRun(session *mgo.Session) {
 				ready[o] <- 1
 			default:
 				// skip this one, it is busy, channel is probably filled or RPC is stuck
+				log.Println("WARNING: skipping busy collector", o)
 			}
 		}
 		time.Sleep(time.Duration(conf.Collector.Interval) * time.Second)
@@ -617,6 +957,12 @@ func Statistics() {
 		osstotal += v
 	}
 	log.Println(" active oss nids:", osstotal)
+
+	if spool != nil {
+		s := spool.Stats()
+		log.Printf(" spool   : %d documents in %d files (%d MB), %d spooled, %d replayed, %d dropped, %d failed",
+			s.Pending, s.Files, s.Bytes>>20, s.Spooled, s.Replayed, s.Dropped, s.Failed)
+	}
 }
 
 // print times of go routines doing collection and insertion
@@ -671,26 +1017,76 @@ func main() {
 	} else {
 		log.Print("config <ludalo.config> read succesfully")
 	}
+	// older configs do not have capacityInterval and healthInterval
+	if conf.Collector.CapacityInterval <= 0 {
+		conf.Collector.CapacityInterval = 300
+	}
+	if conf.Collector.HealthInterval <= 0 {
+		conf.Collector.HealthInterval = 60
+	}
+	switch conf.Collector.Mode {
+	case "":
+		conf.Collector.Mode = "poll"
+	case "poll", "buffered":
+	default:
+		log.Fatal("unknown collector mode " + conf.Collector.Mode + ", use poll or buffered")
+	}
+	log.Print("collector mode " + conf.Collector.Mode)
+	switch conf.Database.Layout {
+	case "":
+		conf.Database.Layout = "flat"
+	case "flat", "compact":
+	default:
+		log.Fatal("unknown database layout " + conf.Database.Layout + ", use flat or compact")
+	}
+
+	for _, tier := range conf.Rollup.Tiers {
+		if _, ok := tierWidths[tier]; !ok {
+			log.Fatal("unknown rollup tier " + tier + ", use 1m, 1h or 1d")
+		}
+	}
+	for kind := range conf.Rollup.Retention {
+		known := kind == "raw"
+		for _, k := range retentionKinds {
+			known = known || kind == k
+		}
+		if !known {
+			log.Fatal("unknown kind " + kind + " in retention, use raw, 1m, 1h, 1d, jobstats, brwstats or capacity")
+		}
+	}
+	if conf.Rollup.PurgeInterval <= 0 {
+		conf.Rollup.PurgeInterval = 3600
+	}
+	log.Print("rollup tiers ", conf.Rollup.Tiers, ", retention in days ", conf.Rollup.Retention)
 
 	// hostmapping
 	hostmap.readFile(conf.Nidmapping.Hostfile)
 
-	// prepare mongo connection
-	session, err := mgo.Dial(conf.Database.Server)
+	// TLS towards collectors
+	var err error
+	clientTLS, err = lustreserver.ClientTLS(conf.TLS)
 	if err != nil {
-		log.Print("could not connected to mongo server " + conf.Database.Server)
+		log.Print("could not setup TLS:")
 		log.Fatal(err)
-	} else {
-		log.Print("connected to mongo server " + conf.Database.Server)
 	}
-	// make session a Safe Session with error checking FIXME good idea???
-	session.SetSafe(&mgo.Safe{})
+	if clientTLS != nil {
+		log.Print("using TLS for RPC")
+	}
+
+	// storage for the data, mongo and/or files
+	out := makeSinks()
+	writeRollupInfo(out)
+	if len(conf.Rollup.Retention) > 0 && collectionNames != nil {
+		go purge(out)
+	}
 
 	// RPC server
 	OssData = make(map[string]lustreserver.OstValues)
+	CapacityData = make(map[string]lustreserver.CapacityValues)
+	HealthData = make(map[string]lustreserver.Health)
 	go startServer()
 
 	// do work
-	aggrRun(session)
+	aggrRun(out)
 
 }
@@ -0,0 +1,132 @@
+package main
+
+// getting samples from collectors, in poll mode the aggregator asks for
+// differences at its own pace, in buffered mode collectors sample on their
+// own and the aggregator pulls all samples since the last one it got, so
+// nothing is lost during short stalls of the inserters or reconnects
+
+import (
+	"github.com/holgerBerger/go_ludalo/lustreserver"
+	"log"
+	"net/rpc"
+)
+
+// snap a timestamp to the configured interval, which allows more efficient DB access later
+func snapTimestamp(t int64) int32 {
+	return int32((t / int64(conf.Collector.SnapInterval)) * int64(conf.Collector.SnapInterval))
+}
+
+// get one sample of OST differences from collector within session, with timestamp of aggregator
+func pollOss(client *rpc.Client, session int64, timestamp int32) (lustreserver.OssSample, error) {
+	// fresh replies each cycle, as RPC decoding would merge into old maps,
+	// and the old ones are still in the channel towards the inserter
+	var sample lustreserver.OssSample
+	err := client.Call("OssRpcT.GetValuesDiff", session, &sample.Values)
+	if err != nil {
+		return sample, err
+	}
+	err = client.Call("OssRpcT.GetJobStatsDiff", session, &sample.Jobs)
+	if err != nil {
+		return sample, err
+	}
+	err = client.Call("OssRpcT.GetBrwStatsDiff", session, &sample.Brw)
+	if err != nil {
+		return sample, err
+	}
+	sample.Values.Timestamp = timestamp
+	sample.Jobs.Timestamp = timestamp
+	sample.Brw.Timestamp = timestamp
+	return sample, nil
+}
+
+// get one sample of MDT differences from collector within session, with timestamp of aggregator
+func pollMds(client *rpc.Client, session int64, timestamp int32) (lustreserver.MdsSample, error) {
+	// fresh replies each cycle, as RPC decoding would merge into old maps,
+	// and the old ones are still in the channel towards the inserter
+	var sample lustreserver.MdsSample
+	err := client.Call("MdsRpcT.GetValuesDiff", session, &sample.Values)
+	if err != nil {
+		return sample, err
+	}
+	err = client.Call("MdsRpcT.GetJobStatsDiff", session, &sample.Jobs)
+	if err != nil {
+		return sample, err
+	}
+	sample.Values.Timestamp = timestamp
+	sample.Jobs.Timestamp = timestamp
+	return sample, nil
+}
+
+// check a batch of samples for samples we missed, first is the oldest sample in the buffer
+// of the collector, lastEpoch and lastSeq are the start time of the sampler and the
+// sequence number of the newest sample we got before,
+// returns false if sampler was restarted and all samples have to be pulled again
+func checkSamples(server string, epoch, first int64, seqs []int64, lastEpoch, lastSeq *int64) bool {
+	if epoch != *lastEpoch {
+		if *lastEpoch != 0 {
+			log.Println("WARNING: collector on", server, "was restarted, samples may be lost")
+		}
+		*lastEpoch = epoch
+		*lastSeq = 0
+		return false
+	}
+	if *lastSeq != 0 && first > *lastSeq+1 {
+		log.Println("WARNING: lost", first-*lastSeq-1, "samples of", server,
+			"buffer of collector too small for stall of aggregator")
+	}
+	if len(seqs) > 0 {
+		*lastSeq = seqs[len(seqs)-1]
+	}
+	return true
+}
+
+// pull all OST samples since the last one we got, timestamps are the ones of the collector, snapped
+func pullOssSamples(server string, client *rpc.Client, epoch, lastSeq *int64) ([]lustreserver.OssSample, error) {
+	for {
+		var reply lustreserver.OssSamples
+		err := client.Call("OssRpcT.GetSamples", *lastSeq, &reply)
+		if err != nil {
+			return nil, err
+		}
+		seqs := make([]int64, len(reply.Samples))
+		for i := range reply.Samples {
+			seqs[i] = reply.Samples[i].Seq
+		}
+		if !checkSamples(server, reply.Epoch, reply.First, seqs, epoch, lastSeq) {
+			continue
+		}
+		for i := range reply.Samples {
+			s := &reply.Samples[i]
+			timestamp := snapTimestamp(int64(s.Values.Timestamp))
+			s.Values.Timestamp = timestamp
+			s.Jobs.Timestamp = timestamp
+			s.Brw.Timestamp = timestamp
+		}
+		return reply.Samples, nil
+	}
+}
+
+// pull all MDT samples since the last one we got, timestamps are the ones of the collector, snapped
+func pullMdsSamples(server string, client *rpc.Client, epoch, lastSeq *int64) ([]lustreserver.MdsSample, error) {
+	for {
+		var reply lustreserver.MdsSamples
+		err := client.Call("MdsRpcT.GetSamples", *lastSeq, &reply)
+		if err != nil {
+			return nil, err
+		}
+		seqs := make([]int64, len(reply.Samples))
+		for i := range reply.Samples {
+			seqs[i] = reply.Samples[i].Seq
+		}
+		if !checkSamples(server, reply.Epoch, reply.First, seqs, epoch, lastSeq) {
+			continue
+		}
+		for i := range reply.Samples {
+			s := &reply.Samples[i]
+			timestamp := snapTimestamp(int64(s.Values.Timestamp))
+			s.Values.Timestamp = timestamp
+			s.Jobs.Timestamp = timestamp
+		}
+		return reply.Samples, nil
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+// batched writes, each inserter collects all documents of a cycle for each
+// collection and writes them with one insert of the sink, for MongoDB one
+// bulk operation instead of one round trip per target and nid
+
+import (
+	"fmt"
+	"github.com/holgerBerger/go_ludalo/sink"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"strings"
+)
+
+// keys of the index of a collection, for the queries of top.py and the rpc server
+func indexKeys(name string) []string {
+	switch {
+	case name == "latesttimestamp" || name == "schema" || name == "rollup":
+		return nil
+	case strings.HasSuffix(name, "_jobstats"):
+		return []string{"ts", "job"}
+	case strings.HasSuffix(name, "_brwstats") || strings.HasSuffix(name, "_capacity"):
+		return []string{"ts"}
+	case conf.Database.Layout == "compact":
+		return []string{"ts", "n.nid"}
+	}
+	return []string{"ts", "nid"}
+}
+
+// batch of documents for several collections
+type batch map[string][]interface{}
+
+func (b batch) add(collection string, doc interface{}) {
+	b[collection] = append(b[collection], doc)
+}
+
+// keys of documents making up their _id, after the server, as a target moving to
+// another server within a rollup bucket has documents from both
+var idKeys = []string{"ts", "ost", "mdt", "nid", "job"}
+
+// set an _id made of the keys of the document, so documents written again, e.g.
+// from the spool after a bulk failed partly, are duplicates and not stored twice
+func setID(server string, doc interface{}) {
+	d, ok := doc.(bson.M)
+	if !ok || d["_id"] != nil {
+		return
+	}
+	id := server
+	for _, key := range idKeys {
+		if v, ok := d[key]; ok {
+			id += fmt.Sprintf(":%v", v)
+		}
+	}
+	d["_id"] = id
+}
+
+// write all documents of batch, errors are logged
+func (b batch) write(server, inserter string, out sink.Sink) {
+	for name, docs := range b {
+		for _, doc := range docs {
+			setID(server, doc)
+		}
+		if err := out.Insert(name, docs); err != nil {
+			log.Println("WARNING: insert error in "+inserter+" for", server)
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/holgerBerger/go_ludalo/lustreserver"
+	"github.com/holgerBerger/go_ludalo/sink"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ossInsert writes samples into a memory sink, in flat and compact layout
+func TestOssInsert(t *testing.T) {
+	insertTimes = make(map[string]float32)
+	insertOSSItems = make(map[string]int32)
+	out := sink.NewMemory()
+	// unbuffered, a send returns after the sample before is written
+	inserter := make(chan lustreserver.OstValues)
+	go ossInsert("oss1", inserter, out)
+
+	v := lustreserver.OstValues{
+		Timestamp: 1000,
+		Delta:     60,
+		OstTotal:  map[string]lustreserver.OstStats{"scratch-OST0000": {WRqs: 3, WBs: 3 << 20}},
+		NidValues: map[string]map[string]lustreserver.OstStats{"scratch-OST0000": {
+			"c1@o2ib": {WRqs: 1, WBs: 1 << 20},
+			"c2@o2ib": {WRqs: 2, WBs: 2 << 20},
+		}},
+		Reset: map[string]bool{"scratch-OST0000": true},
+	}
+	// without targets, only to wait for the sample before
+	empty := lustreserver.OstValues{Timestamp: 1001}
+
+	conf.Database.Layout = "flat"
+	inserter <- v
+	inserter <- empty
+	docs := out.Docs("scratch")
+	if len(docs) != 3 {
+		t.Fatalf("flat: %d documents, expected 3", len(docs))
+	}
+	nids := make(map[string]bson.M)
+	for _, d := range docs {
+		doc := d.(bson.M)
+		if doc["ts"] != 1000 || doc["ost"] != "OST0000" || doc["dt"] != int32(60) {
+			t.Errorf("flat: document %v", doc)
+		}
+		nids[doc["nid"].(string)] = doc
+	}
+	if aggr := nids["aggr"]; aggr["v"] != [4]int64{3, 3 << 20, 0, 0} || aggr["reset"] != true {
+		t.Errorf("flat: OST document %v", aggr)
+	}
+	if c2 := nids["c2"]; c2["v"] != [4]int64{2, 2 << 20, 0, 0} || c2["_id"] != "oss1:1000:OST0000:c2" {
+		t.Errorf("flat: nid document %v", c2)
+	}
+	// the same sample written again, e.g. replayed from the spool, is not stored twice
+	inserter <- v
+	inserter <- empty
+	if docs := out.Docs("scratch"); len(docs) != 3 {
+		t.Fatalf("flat: %d documents after writing sample again, expected 3", len(docs))
+	}
+
+	conf.Database.Layout = "compact"
+	v.Timestamp = 2000
+	empty.Timestamp = 2001
+	inserter <- v
+	inserter <- empty
+	docs = out.Docs("scratch")[3:]
+	if len(docs) != 1 {
+		t.Fatalf("compact: %d documents, expected 1", len(docs))
+	}
+	doc := docs[0].(bson.M)
+	if _, ok := doc["nid"]; ok || len(doc["n"].([]bson.M)) != 2 || doc["v"] != [4]int64{3, 3 << 20, 0, 0} {
+		t.Errorf("compact: document %v", doc)
+	}
+	// the empty sample may be written or not
+	if latest := out.Docs("latesttimestamp"); len(latest) != 1 || latest[0].(map[string]interface{})["latestts"].(int) < 2000 {
+		t.Errorf("latest timestamp %v", latest)
+	}
+}
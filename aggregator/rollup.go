@@ -0,0 +1,257 @@
+package main
+
+// rollups of the performance collections, each inserter sums its samples
+// into buckets of 1 minute, 1 hour and 1 day, written to collections
+// <fs>_1m, <fs>_1h and <fs>_1d when the first sample of a later bucket
+// arrives, in the layout of the performance collections:
+//
+//	ts       start of bucket, covers samples with ts in [ts, ts+width)
+//	ost/mdt  target
+//	nid      nid, aggr for the target (flat layout, in list n for compact)
+//	dt       sum of the intervals of the samples
+//	v        sum of counters, like in samples
+//	max      largest rate per sec of a sample, like v, but as float
+//	ops      sum of operations
+//	samples  number of samples
+//	partial  bucket started before the aggregator, values are missing
+//
+// a target moving to another server in a bucket gets a document from both
+// servers, readers have to sum them. the bucket in progress when the aggregator
+// stops is lost, and the bucket before it may miss the documents of inserters
+// which did not write it yet. each start is recorded in collection rollup,
+// readers take the last bucket before a start and partial buckets from finer
+// tiers or the samples. old documents of all collections are removed by purge,
+// the retention of each tier is configured in days, raw is the collection
+// of the samples, jobstats, brwstats and capacity default to raw, the tiers
+// and retentions are recorded in collection rollup, so top.py can pick a tier
+// for a query
+
+import (
+	"fmt"
+	"github.com/holgerBerger/go_ludalo/lustreserver"
+	"github.com/holgerBerger/go_ludalo/sink"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"strings"
+	"time"
+)
+
+// known tiers, width in secs
+var tierWidths = map[string]int{"1m": 60, "1h": 3600, "1d": 86400}
+
+// suffixes of collections of a filesystem with their own retention, others are raw
+var retentionKinds = []string{"1m", "1h", "1d", "jobstats", "brwstats", "capacity"}
+
+// key of a value in a bucket, nid is aggr for the target
+type rollupKey struct {
+	fs, kind, target, nid string
+	bucket                int
+}
+
+// values of a target or nid in a bucket, mdt total is in v[0]
+type rollupValue struct {
+	dt      int32
+	samples int
+	v       [4]int64
+	max     [4]float64
+	ops     lustreserver.OpStats
+}
+
+// rollup sums the samples of one inserter for one tier
+type rollup struct {
+	tier    string
+	width   int
+	first   int // first bucket, partial
+	current int // latest bucket
+	values  map[rollupKey]*rollupValue
+}
+
+// rollups for the configured tiers
+func newRollups() []*rollup {
+	rollups := []*rollup{}
+	for _, tier := range conf.Rollup.Tiers {
+		rollups = append(rollups, &rollup{tier: tier, width: tierWidths[tier], first: -1, current: -1,
+			values: make(map[rollupKey]*rollupValue)})
+	}
+	return rollups
+}
+
+// start a sample with timestamp ts, buckets before the bucket of ts are finished and added to docs
+func (r *rollup) start(ts int, docs batch) {
+	bucket := ts - ts%r.width
+	if r.first < 0 {
+		r.first = bucket
+	}
+	if bucket > r.current {
+		r.current = bucket
+	}
+	finished := make(map[rollupKey]*rollupValue)
+	for key, value := range r.values {
+		if key.bucket < r.current {
+			finished[key] = value
+			delete(r.values, key)
+		}
+	}
+	if len(finished) > 0 {
+		r.write(finished, docs)
+	}
+}
+
+// add values of a target (nid aggr) or nid of a sample
+func (r *rollup) add(fs, kind, target, nid string, ts int, dt int32, v [4]int64, ops lustreserver.OpStats) {
+	key := rollupKey{fs, kind, target, nid, ts - ts%r.width}
+	value, ok := r.values[key]
+	if !ok {
+		value = &rollupValue{ops: make(lustreserver.OpStats)}
+		r.values[key] = value
+	}
+	value.dt += dt
+	value.samples++
+	for i := range v {
+		value.v[i] += v[i]
+		if dt > 0 && float64(v[i])/float64(dt) > value.max[i] {
+			value.max[i] = float64(v[i]) / float64(dt)
+		}
+	}
+	for op, n := range ops {
+		value.ops[op] += n
+	}
+}
+
+// add OST values of a target (nid aggr) or nid of a sample
+func (r *rollup) addOst(fs, ost, nid string, ts int, dt int32, stats lustreserver.OstStats) {
+	r.add(fs, "ost", ost, nid, ts, dt, [4]int64{stats.WRqs, stats.WBs, stats.RRqs, stats.RBs}, stats.Ops)
+}
+
+// add MDT values of a target (nid aggr) or nid of a sample
+func (r *rollup) addMdt(fs, mdt, nid string, ts int, dt int32, ops lustreserver.OpStats) {
+	r.add(fs, "mdt", mdt, nid, ts, dt, [4]int64{ops.Total()}, ops)
+}
+
+// document of a value, counters like in the samples of kind
+func (r *rollup) doc(key rollupKey, value *rollupValue) bson.M {
+	doc := bson.M{"dt": value.dt, "samples": value.samples}
+	if key.kind == "mdt" {
+		doc["v"] = int(value.v[0])
+		doc["max"] = value.max[0]
+	} else {
+		doc["v"] = value.v
+		doc["max"] = value.max
+	}
+	if len(value.ops) > 0 {
+		doc["ops"] = value.ops
+	}
+	return doc
+}
+
+// add documents of finished buckets to docs, in the configured layout
+func (r *rollup) write(values map[rollupKey]*rollupValue, docs batch) {
+	targets := make(map[rollupKey]bson.M)
+	nids := make(map[rollupKey][]bson.M)
+	for key, value := range values {
+		doc := r.doc(key, value)
+		doc["nid"] = key.nid
+		if key.nid == "aggr" {
+			doc["ts"] = key.bucket
+			doc[key.kind] = key.target
+			if key.bucket == r.first {
+				doc["partial"] = true
+			}
+			key.nid = ""
+			targets[key] = doc
+			continue
+		}
+		if conf.Database.Layout == "compact" {
+			// dt of target, like in samples
+			delete(doc, "dt")
+			key.nid = ""
+			nids[key] = append(nids[key], doc)
+			continue
+		}
+		doc["ts"] = key.bucket
+		doc[key.kind] = key.target
+		docs.add(key.fs+"_"+r.tier, doc)
+	}
+	for key, doc := range targets {
+		if conf.Database.Layout == "compact" {
+			delete(doc, "nid")
+			if nids[key] == nil {
+				nids[key] = []bson.M{}
+			}
+			doc["n"] = nids[key]
+		}
+		docs.add(key.fs+"_"+r.tier, doc)
+	}
+}
+
+// record tiers and retentions for readers, and the start, buckets written before
+// may be incomplete
+func writeRollupInfo(out sink.Sink) {
+	now := time.Now().Unix()
+	err := out.Upsert("rollup", bson.M{"_id": "tiers"},
+		bson.M{"tiers": conf.Rollup.Tiers, "retention": conf.Rollup.Retention, "ts": now})
+	if err != nil {
+		log.Println("WARNING: could not record rollup tiers")
+		log.Println(err)
+	}
+	if len(conf.Rollup.Tiers) == 0 {
+		return
+	}
+	err = out.Insert("rollup", []interface{}{bson.M{"_id": fmt.Sprintf("start:%d", now), "start": now}})
+	if err != nil {
+		log.Println("WARNING: could not record start for rollup tiers")
+		log.Println(err)
+	}
+}
+
+// retention of collection name in days, 0 is forever, by the suffix of
+// the filesystem collections, collections without suffix are raw
+func retention(name string) int {
+	if strings.HasPrefix(name, "system.") || name == "schema" || name == "rollup" || name == "latesttimestamp" {
+		return 0
+	}
+	kind := "raw"
+	if i := strings.LastIndex(name, "_"); i > 0 {
+		for _, k := range retentionKinds {
+			if name[i+1:] == k {
+				kind = k
+			}
+		}
+	}
+	days, ok := conf.Rollup.Retention[kind]
+	if _, tier := tierWidths[kind]; !ok && !tier {
+		days = conf.Rollup.Retention["raw"]
+	}
+	return days
+}
+
+// remove documents older than their retention, each purge interval, from all
+// collections of the database, also of filesystems not seen since the start
+func purge(out sink.Sink) {
+	for {
+		time.Sleep(time.Duration(conf.Rollup.PurgeInterval) * time.Second)
+		names, err := collectionNames()
+		if err != nil {
+			log.Println("WARNING: could not list collections for purge")
+			log.Println(err)
+			continue
+		}
+		purgeCollections(out, names, time.Now().Unix())
+	}
+}
+
+// remove documents older than their retention at now from collections names,
+// collections of others like the jobs have no ts, nothing is removed
+func purgeCollections(out sink.Sink, names []string, now int64) {
+	for _, name := range names {
+		days := retention(name)
+		if days <= 0 {
+			continue
+		}
+		err := out.Remove(name, bson.M{"ts": bson.M{"$lt": int(now) - days*86400}})
+		if err != nil {
+			log.Println("WARNING: purge error in", name)
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/holgerBerger/go_ludalo/lustreserver"
+	"github.com/holgerBerger/go_ludalo/sink"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// samples of a minute are summed, and written with the first sample of the next minute
+func TestRollup(t *testing.T) {
+	conf.Rollup.Tiers = []string{"1m", "1h"}
+	defer func() { conf.Rollup.Tiers = nil }()
+
+	for _, layout := range []string{"flat", "compact"} {
+		conf.Database.Layout = layout
+		rollups := newRollups()
+		sample := func(ts int, wbs int64) batch {
+			docs := make(batch)
+			for _, r := range rollups {
+				r.start(ts, docs)
+				r.addOst("scratch", "OST0000", "aggr", ts, 10, lustreserver.OstStats{WRqs: 1, WBs: wbs})
+				r.addOst("scratch", "OST0000", "c1", ts, 10, lustreserver.OstStats{WRqs: 1, WBs: wbs})
+				r.addMdt("scratch", "MDT0000", "aggr", ts, 10, lustreserver.OpStats{"open": 5, "close": 5})
+			}
+			return docs
+		}
+
+		for _, ts := range []int{130, 140, 150} {
+			if docs := sample(ts, 100); len(docs) != 0 {
+				t.Errorf("%s: documents before end of bucket %v", layout, docs)
+			}
+		}
+		docs := sample(180, 1000)
+		if len(docs["scratch_1h"]) != 0 {
+			t.Errorf("%s: hour written %v", layout, docs["scratch_1h"])
+		}
+		minute := map[string]bson.M{}
+		for _, d := range docs["scratch_1m"] {
+			doc := d.(bson.M)
+			// aggregator started in this minute
+			if doc["ts"] != 120 || doc["nid"] != "c1" && doc["partial"] != true {
+				t.Errorf("%s: document %v", layout, doc)
+			}
+			if mdt, ok := doc["mdt"]; ok {
+				minute[mdt.(string)] = doc
+			} else if layout == "flat" {
+				minute[doc["nid"].(string)] = doc
+			} else {
+				minute["aggr"] = doc
+				if n := doc["n"].([]bson.M); len(n) != 1 || n[0]["nid"] != "c1" || n[0]["v"] != [4]int64{3, 300, 0, 0} {
+					t.Errorf("%s: nids %v", layout, n)
+				}
+			}
+		}
+		if n := len(minute); layout == "flat" && n != 3 || layout == "compact" && n != 2 {
+			t.Fatalf("%s: minute documents %v", layout, docs["scratch_1m"])
+		}
+		if aggr := minute["aggr"]; aggr["v"] != [4]int64{3, 300, 0, 0} || aggr["dt"] != int32(30) ||
+			aggr["max"] != [4]float64{0.1, 10, 0, 0} || aggr["samples"] != 3 {
+			t.Errorf("%s: OST minute %v", layout, aggr)
+		}
+		if mdt := minute["MDT0000"]; mdt["v"] != 30 || mdt["max"] != 1.0 || mdt["ops"].(lustreserver.OpStats)["open"] != 15 {
+			t.Errorf("%s: MDT minute %v", layout, mdt)
+		}
+
+		// next hour, 1000 bytes of the sample at 180 are in the hour
+		docs = sample(3600, 1)
+		for _, d := range docs["scratch_1h"] {
+			if doc := d.(bson.M); doc["ost"] == "OST0000" && doc["nid"] != "c1" && doc["v"] != [4]int64{4, 1300, 0, 0} {
+				t.Errorf("%s: OST hour %v", layout, doc)
+			}
+		}
+		if len(docs["scratch_1h"]) != len(minute) {
+			t.Errorf("%s: hour documents %v", layout, docs["scratch_1h"])
+		}
+	}
+}
+
+// all collections of filesystems are purged, also without own retention, others are kept
+func TestPurge(t *testing.T) {
+	conf.Rollup.Retention = map[string]int{"raw": 1, "1m": 2, "1d": 0, "capacity": 10}
+	defer func() { conf.Rollup.Retention = nil }()
+
+	out := sink.NewMemory()
+	now := int64(100 * 86400)
+	for _, name := range []string{"scratch", "home", "scratch_1m", "scratch_1d", "scratch_jobstats", "home_brwstats", "scratch_capacity", "latesttimestamp"} {
+		for _, days := range []int{0, 3, 5, 20} {
+			out.Insert(name, []interface{}{bson.M{"ts": int(now) - days*86400}})
+		}
+	}
+	out.Insert("jobs", []interface{}{bson.M{"_id": "1", "start": 0}})
+	purgeCollections(out, append(out.Collections(), "system.indexes"), now)
+
+	for name, kept := range map[string]int{"scratch": 1, "home": 1, "scratch_1m": 1, "scratch_1d": 4,
+		"scratch_jobstats": 1, "home_brwstats": 1, "scratch_capacity": 3, "latesttimestamp": 4, "jobs": 1} {
+		if docs := out.Docs(name); len(docs) != kept {
+			t.Errorf("%s: %d documents kept, expected %d", name, len(docs), kept)
+		}
+	}
+}
+
+// each start is recorded for readers, the last bucket before it may be incomplete
+func TestRollupInfo(t *testing.T) {
+	conf.Rollup.Tiers = []string{"1m"}
+	defer func() { conf.Rollup.Tiers = nil }()
+
+	out := sink.NewMemory()
+	writeRollupInfo(out)
+	docs := out.Docs("rollup")
+	if len(docs) != 2 || docs[1].(bson.M)["start"] == nil {
+		t.Errorf("rollup info %v", docs)
+	}
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"github.com/holgerBerger/go_ludalo/lustreserver"
+	"github.com/holgerBerger/go_ludalo/sink"
 	"log"
-	"net"
 	"net/rpc"
+	"sync"
 )
 
-// global variables for RPC access
+// global variables for RPC access, written by collect go routines,
+// protected by dataLock
 var (
-	OssData map[string]lustreserver.OstValues
+	OssData      map[string]lustreserver.OstValues
+	CapacityData map[string]lustreserver.CapacityValues
+	HealthData   map[string]lustreserver.Health
+	dataLock     sync.Mutex
 )
 
 type ServerRpcT int
@@ -18,7 +23,12 @@ type ServerRpcT int
 func startServer() {
 	server := new(ServerRpcT)
 	rpc.Register(server)
-	l, e := net.Listen("tcp", "localhost:2345") // FIXME get port from config file
+	// same certificate as towards collectors, clients like top need a certificate signed by CA
+	config, e := lustreserver.ServerTLS(conf.TLS)
+	if e != nil {
+		log.Fatal("TLS error:", e)
+	}
+	l, e := lustreserver.Listen("localhost:2345", config) // FIXME get port from config file
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
@@ -29,6 +39,8 @@ func startServer() {
 
 // OssList returns list of OSS
 func (*ServerRpcT) OssList(in int, result *[]string) error {
+	dataLock.Lock()
+	defer dataLock.Unlock()
 	*result = make([]string, len(OssData))
 	i := 0
 	for v := range OssData {
@@ -40,6 +52,8 @@ func (*ServerRpcT) OssList(in int, result *[]string) error {
 
 // OstList return list of all OSTs of all OSSes, in form FS-TARGET
 func (*ServerRpcT) OstList(in int, result *[]string) error {
+	dataLock.Lock()
+	defer dataLock.Unlock()
 	c := 0
 	// count osts
 	for v := range OssData {
@@ -56,3 +70,35 @@ func (*ServerRpcT) OstList(in int, result *[]string) error {
 	}
 	return nil
 }
+
+// Capacity returns latest capacity of all OSTs and MDTs of all servers, in form FS-TARGET
+func (*ServerRpcT) Capacity(in int, result *map[string]lustreserver.TargetCapacity) error {
+	dataLock.Lock()
+	defer dataLock.Unlock()
+	*result = make(map[string]lustreserver.TargetCapacity)
+	for v := range CapacityData {
+		for t, c := range CapacityData[v].Targets {
+			(*result)[t] = c
+		}
+	}
+	return nil
+}
+
+// Health returns latest health of all collectors, by server
+func (*ServerRpcT) Health(in int, result *map[string]lustreserver.Health) error {
+	dataLock.Lock()
+	defer dataLock.Unlock()
+	*result = make(map[string]lustreserver.Health)
+	for v := range HealthData {
+		(*result)[v] = HealthData[v]
+	}
+	return nil
+}
+
+// Spool returns the counters of the spool, zero if no spool is configured
+func (*ServerRpcT) Spool(in int, result *sink.SpoolStats) error {
+	if spool != nil {
+		*result = spool.Stats()
+	}
+	return nil
+}
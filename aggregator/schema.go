@@ -0,0 +1,83 @@
+package main
+
+// version of the document format in the database, recorded in collection
+// schema, so readers like top.py can detect the format and the aggregator
+// does not mix formats in one database
+//
+//	1  counters of OSTs and jobs in v as float32 (no schema record)
+//	2  counters of OSTs and jobs in v as int64
+//
+// the layout of the performance collections is recorded as well, flat
+// (a document for each target and nid, missing in older records) or
+// compact (a document for each target, with its nids in list n)
+
+import (
+	"gopkg.in/mgo.v2"
+	"log"
+	"time"
+)
+
+// schemaVersion is the format written by this aggregator, has to match migrate
+const schemaVersion = 2
+
+// schemaDoc is the document in collection schema
+type schemaDoc struct {
+	ID      string `bson:"_id"`
+	Version int    `bson:"version"`
+	Ts      int64  `bson:"ts"` // time the version was recorded
+	Layout  string `bson:"layout,omitempty"`
+}
+
+// readSchema returns the schema version and layout of the database, a database
+// without record is version 1 if it has data, and 0 if it is empty
+func readSchema(db *mgo.Database) (int, string, error) {
+	var doc schemaDoc
+	err := db.C("schema").FindId("ludalo").One(&doc)
+	if err == nil {
+		if doc.Layout == "" {
+			doc.Layout = "flat"
+		}
+		return doc.Version, doc.Layout, nil
+	}
+	if err != mgo.ErrNotFound {
+		return 0, "", err
+	}
+	names, err := db.CollectionNames()
+	if err != nil {
+		return 0, "", err
+	}
+	for _, name := range names {
+		if name != "system.indexes" {
+			return 1, "flat", nil
+		}
+	}
+	return 0, "", nil
+}
+
+// checkSchema makes sure the database has our format and the configured layout,
+// an empty database gets our version, a database with an older format has to be
+// migrated first
+func checkSchema(db *mgo.Database) {
+	version, layout, err := readSchema(db)
+	if err != nil {
+		log.Print("could not read schema version of database " + conf.Database.Name)
+		log.Fatal(err)
+	}
+	switch {
+	case version == 0:
+		_, err = db.C("schema").UpsertId("ludalo", schemaDoc{"ludalo", schemaVersion, time.Now().Unix(), conf.Database.Layout})
+		if err != nil {
+			log.Print("could not record schema version")
+			log.Fatal(err)
+		}
+		log.Print("new database, schema version ", schemaVersion, ", layout ", conf.Database.Layout)
+	case version < schemaVersion:
+		log.Fatal("database has schema version ", version, ", run migrate to convert it to version ", schemaVersion)
+	case version > schemaVersion:
+		log.Fatal("database has schema version ", version, ", this aggregator writes version ", schemaVersion, ", update aggregator")
+	case layout != conf.Database.Layout:
+		log.Fatal("database has layout ", layout, ", but layout ", conf.Database.Layout, " is configured")
+	default:
+		log.Print("schema version ", version, ", layout ", layout)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+// sinks the inserters write to, configured with [[sink]] sections,
+// without any, the database of [database] is used like before.
+// several sinks get the same documents, e.g. to archive samples in
+// files while the database is migrated
+
+import (
+	"github.com/holgerBerger/go_ludalo/sink"
+	"log"
+	"strconv"
+	"time"
+)
+
+// spool of the mongo sink, nil if not configured
+var spool *sink.Spool
+
+// collections of the mongo sink, for purge, nil without mongo sink
+var collectionNames func() ([]string, error)
+
+// makeSinks creates the configured sinks, errors are fatal
+func makeSinks() sink.Sink {
+	if len(conf.Sinks) == 0 {
+		conf.Sinks = []sinkConfig{{Type: "mongo"}}
+	}
+	var sinks sink.Multi
+	for _, s := range conf.Sinks {
+		switch s.Type {
+		case "mongo":
+			m, err := sink.NewMongo(conf.Database.Server, conf.Database.Name, indexKeys)
+			if err != nil {
+				log.Print("could not connected to mongo server " + conf.Database.Server)
+				log.Fatal(err)
+			}
+			log.Print("connected to mongo server " + conf.Database.Server)
+			checkSchema(m.DB())
+			collectionNames = m.DB().CollectionNames
+			if conf.Spool.Dir == "" {
+				sinks = append(sinks, m)
+				break
+			}
+			if spool != nil {
+				log.Fatal("spool can only be used for one mongo sink")
+			}
+			if conf.Spool.Retry <= 0 {
+				conf.Spool.Retry = 60
+			}
+			spool, err = sink.NewSpool(m, conf.Spool.Dir, int64(conf.Spool.MaxSize)<<20, time.Duration(conf.Spool.Retry)*time.Second)
+			if err != nil {
+				log.Print("could not use directory " + conf.Spool.Dir + " for spool")
+				log.Fatal(err)
+			}
+			log.Print("spooling failed writes to " + conf.Spool.Dir)
+			sinks = append(sinks, spool)
+		case "file":
+			if s.Dir == "" {
+				log.Fatal("sink of type file needs dir")
+			}
+			f, err := sink.NewFile(s.Dir, int64(s.MaxSize)<<20, time.Duration(s.MaxAge)*time.Second)
+			if err != nil {
+				log.Print("could not use directory " + s.Dir + " for sink")
+				log.Fatal(err)
+			}
+			log.Print("writing JSON lines to " + s.Dir + ", new file after " +
+				strconv.Itoa(s.MaxSize) + " MB or " + strconv.Itoa(s.MaxAge) + " secs (0 is unlimited)")
+			sinks = append(sinks, f)
+		default:
+			log.Fatal("unknown sink type " + s.Type + ", use mongo or file")
+		}
+	}
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return sinks
+}
@@ -149,9 +149,7 @@ func main() {
 
 	totaljobs = 0
 
-	// mongo setup
-	// async is not faster with merging opt, can be avoided
-	// mongo := NewAsynchMongo()
+	// sink setup
 	mongo := NewMongo()
 
 	// switch of output for the files on command line
@@ -13,6 +13,15 @@ type Config struct {
 	MongoServer    string
 	MongoDB        string
 	Collection     string
+	Sinks          []sinkConfig `toml:"sink"`
+}
+
+// sink for jobs, like the sinks of the aggregator
+type sinkConfig struct {
+	Type    string // mongo (with MongoServer and MongoDB) or file
+	Dir     string // file: directory for the files
+	MaxSize int    // file: MB per file, 0 is unlimited
+	MaxAge  int    // file: secs per file, 0 is unlimited
 }
 
 // global variable with config
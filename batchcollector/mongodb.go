@@ -2,9 +2,11 @@ package main
 
 import (
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/holgerBerger/go_ludalo/sink"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -15,10 +17,10 @@ const (
 	retryDelay = 5
 )
 
-// MongoDB is a mongo connection and methods to insert data into db
+// MongoDB writes jobs into the configured sinks, by default the mongo database
 type MongoDB struct {
-	session    *mgo.Session
-	db         *mgo.Database
+	sinks      []sink.Sink
+	db         *mgo.Database // database of the mongo sink, nil without one
 	collection *mgo.Collection
 }
 
@@ -34,92 +36,121 @@ type Jobentry struct {
 	Calc  int    `bson:"calc"`
 }
 
-// NewMongo creates db connection
+// NewMongo creates the configured sinks, without any the mongo database
 func NewMongo() *MongoDB {
 	mongo := new(MongoDB)
-	var err error
 
-	mongo.session, err = mgo.Dial(config.MongoServer)
-	if err != nil {
-		panic("could not access mongo DB on " + config.MongoServer)
+	if len(config.Sinks) == 0 {
+		config.Sinks = []sinkConfig{{Type: "mongo"}}
+	}
+	for _, s := range config.Sinks {
+		switch s.Type {
+		case "mongo":
+			m, err := sink.NewMongo(config.MongoServer, config.MongoDB, nil)
+			if err != nil {
+				panic("could not access mongo DB on " + config.MongoServer)
+			}
+			mongo.db = m.DB()
+			mongo.collection = mongo.db.C(config.Collection)
+			mongo.sinks = append(mongo.sinks, m)
+		case "file":
+			if s.Dir == "" {
+				panic("sink of type file needs dir")
+			}
+			f, err := sink.NewFile(s.Dir, int64(s.MaxSize)<<20, time.Duration(s.MaxAge)*time.Second)
+			if err != nil {
+				panic("could not use directory " + s.Dir + " for sink: " + err.Error())
+			}
+			log.Println("writing JSON lines to " + s.Dir + ", new file after " +
+				strconv.Itoa(s.MaxSize) + " MB or " + strconv.Itoa(s.MaxAge) + " secs (0 is unlimited)")
+			mongo.sinks = append(mongo.sinks, f)
+		default:
+			panic("unknown sink type " + s.Type + ", use mongo or file")
+		}
 	}
-
-	mongo.db = mongo.session.DB(config.MongoDB)
-	mongo.collection = mongo.db.C(config.Collection)
 
 	return mongo
 }
 
+// write into all sinks with f, retrying while a sink is not reachable,
+// jobs which are already known (files read again) are no error
+func (m *MongoDB) write(what string, f func(s sink.Sink) error) {
+	for _, s := range m.sinks {
+		for delay := 1; ; delay++ {
+			err := f(s)
+			if err == nil {
+				break
+			}
+			if r, ok := err.(*sink.Rejected); ok && mgo.IsDup(r.Err) {
+				break
+			}
+			if !unreachable(err) || delay >= retryCount {
+				log.Println("    error in", what, err)
+				break
+			}
+			log.Println("    error in", what, "waiting...", err, delay, "/", retryCount)
+			time.Sleep(retryDelay * time.Second)
+		}
+	}
+}
+
+// errors of a lost connection to the database, other errors are not retried
+func unreachable(err error) bool {
+	return strings.Contains(err.Error(), "no reachable") || err.Error() == "EOF"
+}
+
 // InsertJob inserts a job into database
 func (m *MongoDB) InsertJob(jobid string, start time.Time) {
-	var delay = 1
-retryInsert:
-	err := m.collection.Insert(bson.M{
-		"_id":   strings.Trim(jobid, "'"),
-		"jobid": strings.Trim(jobid, "'"),
-		"owner": "",
-		"start": int32(start.Unix()),
-		"end":   -1,
-		"nids":  "",
-		"cmd":   "",
-		"calc":  -1,
+	m.InsertCompleteJob(Jobentry{
+		ID:    strings.Trim(jobid, "'"),
+		Jobid: strings.Trim(jobid, "'"),
+		Start: int32(start.Unix()),
+		End:   -1,
+		Calc:  -1,
 	})
-	if err != nil && !mgo.IsDup(err) && (strings.Contains(err.Error(), "no reachable") || err.Error() == "EOF") && delay < retryCount {
-		log.Println("    error in insert, refreshing session and waiting...", err, delay, "/", retryCount)
-		m.session.Refresh()
-		time.Sleep(retryDelay * time.Second)
-		delay += 1
-		goto retryInsert
-	}
 }
 
 // InsertCompleteJob inserts a filled jobentry struct
 func (m *MongoDB) InsertCompleteJob(job Jobentry) {
-	var delay = 1
-retryInsert:
-	err := m.collection.Insert(&job)
-	if err != nil && !mgo.IsDup(err) && (strings.Contains(err.Error(), "no reachable") || err.Error() == "EOF") && delay < retryCount {
-		log.Println("    error in insert, refreshing session and waiting...", err, delay, "/", retryCount)
-		m.session.Refresh()
-		time.Sleep(retryDelay * time.Second)
-		delay += 1
-		goto retryInsert
+	doc := bson.M{
+		"_id":   job.ID,
+		"jobid": job.Jobid,
+		"owner": job.Owner,
+		"start": job.Start,
+		"end":   job.End,
+		"cmd":   job.Cmd,
+		"nids":  job.Nids,
+		"calc":  job.Calc,
 	}
+	if job.ID == "" {
+		delete(doc, "_id")
+	}
+	m.write("insert", func(s sink.Sink) error {
+		return s.Insert(config.Collection, []interface{}{doc})
+	})
 }
 
-// AddJobInfo inserts a job into database
+// AddJobInfo sets owner, command and nodes of a job inserted before
 func (m *MongoDB) AddJobInfo(jobid, uid, cmd, nids string) {
 	query := bson.M{"_id": strings.Trim(jobid, "'")}
-	change := bson.M{"$set": bson.M{"owner": uid, "cmd": strings.Trim(cmd, "'"), "nids": nids}}
-	var delay = 1
-retryUpdate:
-	err := m.collection.Update(query, change)
-	if err != nil && (strings.Contains(err.Error(), "no reachable") || err.Error() == "EOF") && delay < retryCount {
-		log.Println("    error in update, refreshing session and waiting...", err, delay)
-		m.session.Refresh()
-		time.Sleep(retryDelay * time.Second)
-		delay += 1
-		goto retryUpdate
-	}
+	change := bson.M{"owner": uid, "cmd": strings.Trim(cmd, "'"), "nids": nids}
+	m.write("update", func(s sink.Sink) error {
+		return s.Update(config.Collection, query, change)
+	})
 }
 
-// EndJob inserts a job into database
+// EndJob sets the end of a job inserted before
 func (m *MongoDB) EndJob(jobid string, end time.Time) {
 	query := bson.M{"_id": strings.Trim(jobid, "'")}
-	change := bson.M{"$set": bson.M{"end": int32(end.Unix())}}
-	var delay = 1
-retryUpdate:
-	err := m.collection.Update(query, change)
-	if err != nil && (strings.Contains(err.Error(), "no reachable") || err.Error() == "EOF") && delay < retryCount {
-		log.Println("    error in update, refreshing session and waiting...", err, delay)
-		m.session.Refresh()
-		time.Sleep(retryDelay * time.Second)
-		delay += 1
-		goto retryUpdate
-	}
+	change := bson.M{"end": int32(end.Unix())}
+	m.write("update", func(s sink.Sink) error {
+		return s.Update(config.Collection, query, change)
+	})
 }
 
-// Shutdown dummy for synch inserter
+// Shutdown closes the sinks
 func (m *MongoDB) Shutdown() {
-
+	for _, s := range m.sinks {
+		s.Close()
+	}
 }
@@ -7,36 +7,207 @@
 package main
 
 import (
-	"fmt"
 	"github.com/holgerBerger/go_ludalo/lustreserver"
+	"github.com/holgerBerger/go_ludalo/lustresim"
+	"github.com/jessevdk/go-flags"
+	"log"
+	"net"
 	"os"
+	"strconv"
+	"time"
 )
 
+// BuildID contains Build Date
+var BuildID string
+
+// Hash contains git hash of commit
+var Hash string
+
+// options overwrite values from config file
+var opts struct {
+	Config         string   `long:"config" short:"c" description:"config file, see collector.conf."`
+	Listen         string   `long:"listen" short:"l" description:"address to listen on for RPC (default 0.0.0.0)."`
+	Port           int      `long:"port" short:"P" description:"port for RPC, has to match port in ludalo.config (default 1234)."`
+	Procdir        string   `long:"procdir" short:"p" description:"root of lustre proc tree, can point to a recorded snapshot for testing (default /proc/fs/lustre/)."`
+	Sysdir         string   `long:"sysdir" description:"root of lustre sysfs tree (default /sys/fs/lustre/)."`
+	Debugdir       string   `long:"debugdir" description:"root of lustre debugfs tree (default /sys/kernel/debug/lustre/)."`
+	Source         string   `long:"source" short:"s" description:"where to read lustre parameters from: files, lctl or auto (default auto)."`
+	Simulate       string   `long:"simulate" description:"serve a simulated lustre server instead, \"default\" or a scenario file, see sim.conf."`
+	NidInclude     []string `long:"nid-include" description:"regular expression of nids to collect, can be given several times."`
+	NidExclude     []string `long:"nid-exclude" description:"regular expression of nids to skip, can be given several times."`
+	TopNids        *int     `long:"top-nids" description:"send only the busiest nids per target, rest is summed up as other, 0 for all (default 0)."`
+	ExportRefresh  int      `long:"export-refresh" description:"seconds after which exports of a target are read again at the latest (default 60)."`
+	Readers        int      `long:"readers" description:"number of goroutines reading stats files (default 8)."`
+	ReadTimeout    *int     `long:"read-timeout" description:"seconds after which reading stats stops and incomplete values are returned, 0 for no limit (default 5)."`
+	SampleInterval *int     `long:"sample-interval" description:"seconds between samples kept in a buffer for buffered mode, 0 to not sample (default 0)."`
+	BufferSize     int      `long:"buffer-size" description:"number of samples kept for buffered mode (default 60)."`
+	TLSCert        string   `long:"tls-cert" description:"certificate of collector in PEM, enables TLS."`
+	TLSKey         string   `long:"tls-key" description:"private key of collector in PEM."`
+	TLSCA          string   `long:"tls-ca" description:"CA certificate in PEM, clients have to present a certificate signed by it."`
+	Logfile        string   `long:"logfile" description:"write log to this file instead of stderr."`
+}
+
 func main() {
 
+	// option parsing
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		os.Exit(1)
+	}
+	if opts.Config != "" {
+		readConf(opts.Config)
+	}
+	if opts.Listen != "" {
+		config.Listen = opts.Listen
+	}
+	if opts.Port != 0 {
+		config.Port = opts.Port
+	}
+	if opts.Procdir != "" {
+		config.Procdir = opts.Procdir
+	}
+	if opts.Sysdir != "" {
+		config.Sysdir = opts.Sysdir
+	}
+	if opts.Debugdir != "" {
+		config.Debugdir = opts.Debugdir
+	}
+	if opts.Source != "" {
+		config.Source = opts.Source
+	}
+	if opts.Simulate != "" {
+		config.Simulate = opts.Simulate
+	}
+	if len(opts.NidInclude) > 0 {
+		config.NidInclude = opts.NidInclude
+	}
+	if len(opts.NidExclude) > 0 {
+		config.NidExclude = opts.NidExclude
+	}
+	// pointer, as 0 is a valid value
+	if opts.TopNids != nil {
+		config.TopNids = *opts.TopNids
+	}
+	if opts.ExportRefresh != 0 {
+		config.ExportRefresh = opts.ExportRefresh
+	}
+	if opts.Readers != 0 {
+		config.Readers = opts.Readers
+	}
+	// pointer, as 0 is a valid value
+	if opts.ReadTimeout != nil {
+		config.ReadTimeout = *opts.ReadTimeout
+	}
+	// pointer, as 0 is a valid value
+	if opts.SampleInterval != nil {
+		config.SampleInterval = *opts.SampleInterval
+	}
+	if opts.BufferSize != 0 {
+		config.BufferSize = opts.BufferSize
+	}
+	if opts.TLSCert != "" {
+		config.TLSCert = opts.TLSCert
+	}
+	if opts.TLSKey != "" {
+		config.TLSKey = opts.TLSKey
+	}
+	if opts.TLSCA != "" {
+		config.TLSCA = opts.TLSCA
+	}
+	if opts.Logfile != "" {
+		config.Logfile = opts.Logfile
+	}
+
+	if config.Logfile != "" {
+		f, err := os.OpenFile(config.Logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(f)
+	}
+
 	hostname, _ := os.Hostname()
-	fmt.Printf("go collector running on " + hostname + "\n")
+	log.Print("go collector running on " + hostname)
+	log.Print(" build: ", BuildID, " ", Hash)
+	lustreserver.BuildID = BuildID
+	lustreserver.Hash = Hash
+
+	lustreserver.SetProcdir(config.Procdir)
+	lustreserver.SetSysdir(config.Sysdir)
+	lustreserver.SetDebugdir(config.Debugdir)
+	if config.Simulate != "" {
+		startSimulator(config.Simulate)
+	} else {
+		err = lustreserver.SetSource(config.Source)
+		if err != nil {
+			log.Fatal("bad source: ", err)
+		}
+		log.Print(" reading lustre data from " + config.Source + ": " +
+			lustreserver.Procdir + " " + lustreserver.Sysdir + " " + lustreserver.Debugdir)
+	}
+	err = lustreserver.SetNidFilter(config.NidInclude, config.NidExclude)
+	if err != nil {
+		log.Fatal("bad nid filter: ", err)
+	}
+	lustreserver.SetTopNids(config.TopNids)
+	lustreserver.SetExportRefresh(time.Duration(config.ExportRefresh) * time.Second)
+	lustreserver.SetReaders(config.Readers, time.Duration(config.ReadTimeout)*time.Second)
 
 	lustreserver.MakeServerRPC()
 
-	if _, err := os.Stat(lustreserver.Procdir + "ost"); err == nil {
-		fmt.Printf(" looks like ost, serving ost\n")
+	if lustreserver.HasOST() {
+		log.Print(" looks like ost, serving ost")
 		lustreserver.IsOST = true
 	} else {
-		fmt.Printf(" waiting for ost data\n")
+		log.Print(" waiting for ost data")
 		lustreserver.IsOST = false
 	}
 	lustreserver.MakeOssRPC()
 
-	if _, err := os.Stat(lustreserver.Procdir + "mds"); err == nil {
-		fmt.Printf(" looks like mdt, serving mdt\n")
+	if lustreserver.HasMDT() {
+		log.Print(" looks like mdt, serving mdt")
 		lustreserver.IsMDT = true
 	} else {
-		fmt.Printf(" waiting for mdt data\n")
+		log.Print(" waiting for mdt data")
 		lustreserver.IsMDT = false
 	}
 	lustreserver.MakeMdsRPC()
 
+	if config.SampleInterval > 0 {
+		log.Print(" sampling every ", config.SampleInterval, " secs, keeping ", config.BufferSize, " samples")
+		lustreserver.StartSampler(time.Duration(config.SampleInterval)*time.Second, config.BufferSize)
+	}
+
+	err = lustreserver.SetServerTLS(lustreserver.TLSConfig{Cert: config.TLSCert, Key: config.TLSKey, CA: config.TLSCA})
+	if err != nil {
+		log.Fatal("bad TLS setup: ", err)
+	}
+	if config.TLSCert != "" {
+		log.Print(" using TLS, clients need a certificate signed by " + config.TLSCA)
+	}
+
 	// here we block endless
-	lustreserver.StartServer()
+	address := net.JoinHostPort(config.Listen, strconv.Itoa(config.Port))
+	log.Print(" serving RPC on " + address)
+	lustreserver.StartServer(address)
+}
+
+// startSimulator serves a simulated lustre server, scenario is "default"
+// or a scenario file in TOML
+func startSimulator(scenario string) {
+	simconfig := lustresim.DefaultConfig()
+	if scenario != "default" {
+		var err error
+		simconfig, err = lustresim.ReadConfig(scenario)
+		if err != nil {
+			log.Fatal("bad scenario: ", err)
+		}
+	}
+	sim, err := lustresim.New(simconfig)
+	if err != nil {
+		log.Fatal("bad scenario: ", err)
+	}
+	lustreserver.SetSimulator(sim)
+	log.Print(" simulating lustre ", simconfig.Version, " with ", len(simconfig.Filesystems), " filesystems, ",
+		simconfig.Clients, " clients and ", len(simconfig.Jobs), " jobs from scenario ", scenario)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config represents the config file, all values can be overwritten
+// with command line options
+type Config struct {
+	Listen         string   // address to listen on for RPC
+	Port           int      // port for RPC, has to match port in ludalo.config
+	Procdir        string   // root of lustre proc tree
+	Sysdir         string   // root of lustre sysfs tree, for lustre >= 2.10
+	Debugdir       string   // root of lustre debugfs tree, for lustre >= 2.10
+	Source         string   // where to read parameters from: files, lctl or auto
+	Simulate       string   // serve a simulated server, "default" or a scenario file, empty for lustre
+	NidInclude     []string // regular expressions of nids to collect, all if empty
+	NidExclude     []string // regular expressions of nids to skip
+	TopNids        int      // number of busiest nids sent per target, rest is summed up as other, 0 for all
+	ExportRefresh  int      // seconds after which exports of a target are read again at the latest
+	Readers        int      // number of goroutines reading stats files
+	ReadTimeout    int      // seconds after which reading stats stops, 0 for no limit
+	SampleInterval int      // seconds between samples for buffered mode, 0 to not sample
+	BufferSize     int      // number of samples kept for buffered mode
+	TLSCert        string   // certificate in PEM, enables TLS
+	TLSKey         string   // private key in PEM
+	TLSCA          string   // CA certificate in PEM, clients need a certificate signed by it
+	Logfile        string   // log destination, stderr if empty
+}
+
+// global variable with config, preset with defaults
+var config = Config{
+	Listen:        "0.0.0.0",
+	Port:          1234,
+	Procdir:       "/proc/fs/lustre/",
+	Sysdir:        "/sys/fs/lustre/",
+	Debugdir:      "/sys/kernel/debug/lustre/",
+	Source:        "auto",
+	ExportRefresh: 60,
+	Readers:       8,
+	ReadTimeout:   5,
+	BufferSize:    60,
+}
+
+// readConf reads the config file, nothing more
+func readConf(filename string) {
+	// read config
+	if _, err := toml.DecodeFile(filename, &config); err != nil {
+		// handle error
+		log.Print("error in reading ", filename, ":")
+		log.Fatal(err)
+	}
+}
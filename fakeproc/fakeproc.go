@@ -0,0 +1,169 @@
+// Package fakeproc writes the lustre parameter tree of a simulated server
+// (see lustresim) to disk, like a real server has it below /proc/fs/lustre,
+// /sys/fs/lustre and /sys/kernel/debug/lustre, for tests of the readers
+// in lustreserver and for running a collector without lustre.
+// Each version gets the layout it has on real servers, before 2.10 all is in proc,
+// 2.10 and later keep version, device directories and capacity in sys
+// and brw_stats in debug.
+package fakeproc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/holgerBerger/go_ludalo/lustresim"
+)
+
+// Versions are the lustre versions whose layouts and formats are supported
+var Versions = []string{"1.8.9", "2.5.3", "2.10.8", "2.12.9", "2.15.3"}
+
+// devices written for each target, and their parameter files besides exports
+var (
+	devices = []string{"obdfilter", "osd-ldiskfs", "mdt", "mds"}
+	params  = []string{"stats", "md_stats", "job_stats", "brw_stats", "kbytestotal", "kbytesfree", "filestotal", "filesfree"}
+)
+
+// Tree is a parameter tree below Dir, with roots Procdir, Sysdir and Debugdir,
+// written from Sim
+type Tree struct {
+	Dir      string
+	Procdir  string
+	Sysdir   string
+	Debugdir string
+	Sim      *lustresim.Sim
+	written  map[string]struct{} // device/target directories written last time
+}
+
+// New creates a tree in a new temporary directory, remove it with Remove
+func New(config lustresim.Config) (*Tree, error) {
+	dir, err := ioutil.TempDir("", "fakeproc")
+	if err != nil {
+		return nil, err
+	}
+	t, err := Create(dir, config)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return t, err
+}
+
+// Create creates a tree in dir, with subdirectories proc, sys and debug
+func Create(dir string, config lustresim.Config) (*Tree, error) {
+	sim, err := lustresim.New(config)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree{
+		Dir:      dir,
+		Procdir:  filepath.Join(dir, "proc") + "/",
+		Sysdir:   filepath.Join(dir, "sys") + "/",
+		Debugdir: filepath.Join(dir, "debug") + "/",
+		Sim:      sim,
+		written:  make(map[string]struct{}),
+	}
+	for _, root := range []string{t.Procdir, t.Sysdir, t.Debugdir} {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// files which never change
+	top := t.Procdir
+	if t.sysLayout() {
+		top = t.Sysdir
+	}
+	if err := ioutil.WriteFile(top+"version", sim.VersionFile(), 0644); err != nil {
+		return nil, err
+	}
+	if sim.HasDevice("ost") {
+		os.MkdirAll(top+"ost/OSS", 0755)
+	}
+	if sim.HasDevice("mds") {
+		os.MkdirAll(top+"mds/MDS", 0755)
+	}
+	return t, t.Write()
+}
+
+// Remove removes the tree
+func (t *Tree) Remove() error {
+	return os.RemoveAll(t.Dir)
+}
+
+// Advance advances the simulation by d and writes the tree
+func (t *Tree) Advance(d time.Duration) error {
+	t.Sim.Advance(d)
+	return t.Write()
+}
+
+// Update advances the simulation to the current time and writes the tree
+func (t *Tree) Update() error {
+	t.Sim.Update()
+	return t.Write()
+}
+
+// 2.10 and later have parts in sys and debug
+func (t *Tree) sysLayout() bool {
+	return t.Sim.AtLeast(2, 10)
+}
+
+// root of parameter name in the layout of the simulated version
+func (t *Tree) root(name string) string {
+	if t.sysLayout() {
+		switch name {
+		case "brw_stats":
+			return t.Debugdir
+		case "kbytestotal", "kbytesfree", "filestotal", "filesfree":
+			return t.Sysdir
+		}
+	}
+	return t.Procdir
+}
+
+// Write writes all parameters of all targets, targets which are gone
+// (in failover) are removed
+func (t *Tree) Write() error {
+	current := make(map[string]struct{})
+	for _, device := range devices {
+		for _, target := range t.Sim.Targets(device) {
+			current[device+"/"+target] = struct{}{}
+			for _, name := range params {
+				if err := t.writeParam(device, target, name); err != nil {
+					return err
+				}
+			}
+			for _, nid := range t.Sim.Exports(device, target) {
+				if err := t.writeParam(device, target, "exports/"+nid+"/stats"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for dir := range t.written {
+		if _, ok := current[dir]; !ok {
+			for _, root := range []string{t.Procdir, t.Sysdir, t.Debugdir} {
+				if err := os.RemoveAll(root + dir); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	t.written = current
+	return nil
+}
+
+// write a parameter if the simulated version has it
+func (t *Tree) writeParam(device, target, name string) error {
+	data, err := t.Sim.File(device, target, name)
+	if err != nil {
+		// not there in this version
+		return nil
+	}
+	filename := t.root(name) + device + "/" + target + "/" + name
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
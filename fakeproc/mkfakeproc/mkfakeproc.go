@@ -0,0 +1,58 @@
+// mkfakeproc writes the lustre parameter tree of a simulated server to a directory
+// and keeps it going, a collector can read it like a real server with
+//
+//	collector --source files --procdir <dir>/proc --sysdir <dir>/sys --debugdir <dir>/debug
+
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/holgerBerger/go_ludalo/fakeproc"
+	"github.com/holgerBerger/go_ludalo/lustresim"
+	"github.com/jessevdk/go-flags"
+)
+
+var opts struct {
+	Dir      string `long:"dir" short:"d" required:"true" description:"directory to write the tree to, gets subdirectories proc, sys and debug."`
+	Version  string `long:"version" short:"v" description:"lustre version to simulate, overwrites version of scenario."`
+	Scenario string `long:"scenario" short:"s" description:"scenario file, see collector/sim.conf (default is the built in scenario)."`
+	Interval int    `long:"interval" short:"i" default:"1" description:"seconds between updates of the tree."`
+	Once     bool   `long:"once" description:"write the tree once and exit."`
+}
+
+func main() {
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	config := lustresim.DefaultConfig()
+	if opts.Scenario != "" {
+		config, err = lustresim.ReadConfig(opts.Scenario)
+		if err != nil {
+			log.Fatal("bad scenario: ", err)
+		}
+	}
+	if opts.Version != "" {
+		config.Version = opts.Version
+	}
+
+	tree, err := fakeproc.Create(opts.Dir, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("lustre ", config.Version, " tree in ", opts.Dir)
+	if opts.Once {
+		return
+	}
+
+	for {
+		time.Sleep(time.Duration(opts.Interval) * time.Second)
+		if err := tree.Update(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
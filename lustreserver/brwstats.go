@@ -0,0 +1,171 @@
+package lustreserver
+
+// brw_stats support, OSTs keep histograms of rpc sizes, disk IO sizes
+// and IO times, which show if IO is small and random or large and streaming
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BrwBucket gives number of read and write rpcs or ios in one histogram bucket
+type BrwBucket struct {
+	Read, Write int64
+}
+
+// BrwHistogram maps a bucket like "4K" or "16" to its counts
+type BrwHistogram map[string]BrwBucket
+
+// BrwStats contains the histograms of one OST, with short names from brwHistograms as keys
+type BrwStats map[string]BrwHistogram
+
+// BrwValues contains brw_stats histograms for each OST
+type BrwValues struct {
+	Timestamp int32 // sample time of collector, will be overwritten by aggregator
+	Delta     int32 // time difference
+	OstBrw    map[string]BrwStats
+}
+
+// histograms of brw_stats we collect, and the short names we use for them
+var brwHistograms = map[string]string{
+	"pages per bulk r/w":  "pages",
+	"discontiguous pages": "discont_pages",
+	"disk I/O size":       "disk_iosize",
+	"I/O time (1/1000s)":  "io_time",
+}
+
+// subtract b from a, buckets with zero difference are omitted
+func (a BrwStats) sub(b BrwStats) BrwStats {
+	result := make(BrwStats)
+	for name, histogram := range a {
+		diff := make(BrwHistogram)
+		for bucket, v := range histogram {
+			old := b[name][bucket]
+			d := BrwBucket{v.Read - old.Read, v.Write - old.Write}
+			if d.Read != 0 || d.Write != 0 {
+				diff[bucket] = d
+			}
+		}
+		if len(diff) > 0 {
+			result[name] = diff
+		}
+	}
+	return result
+}
+
+// check for positive values
+func (a BrwStats) positive() bool {
+	for _, histogram := range a {
+		for _, v := range histogram {
+			if v.Read < 0 || v.Write < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GetBrwStatsDiff RPC call for OST, return brw_stats histogram buckets which are not zero,
+// as difference to the last call within the session created with InitDiff
+func (*OssRpcT) GetBrwStatsDiff(session int64, result *BrwValues) error {
+	s, err := getOssSession(session)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if HasOST() {
+		current := readBrwValues(getOstlist())
+		result.Timestamp = current.Timestamp
+		result.Delta = current.Timestamp - s.brw.Timestamp
+		result.OstBrw = make(map[string]BrwStats)
+		for ost := range current.OstBrw {
+			// old value does not exist (failover) or histogram was reset,
+			// so all counts are new
+			diff := current.OstBrw[ost].sub(s.brw.OstBrw[ost])
+			if !diff.positive() {
+				diff = current.OstBrw[ost].sub(nil)
+			}
+			if len(diff) > 0 {
+				result.OstBrw[ost] = diff
+			}
+		}
+		s.brw = current
+	}
+	return nil
+}
+
+// read brw_stats of all OSTs, timestamp is time of reading
+func readBrwValues(ostlist []string) BrwValues {
+	var values BrwValues
+	values.Timestamp = int32(time.Now().Unix())
+	values.OstBrw = make(map[string]BrwStats)
+	for _, ost := range ostlist {
+		values.OstBrw[ost] = readBrwStatsfile(ost)
+	}
+	return values
+}
+
+// devices having brw_stats, newer lustre versions keep them in the osd only
+var brwDevices = []string{"obdfilter", "osd-ldiskfs", "osd-zfs"}
+
+// read brw_stats of an OST, return histograms we are interested in
+// format is a header per histogram, followed by buckets with read and write values:
+//
+//	                           read      |     write
+//	disk I/O size          ios   % cum % |  ios         % cum %
+//	4K:                     38  35  35   |   90   1   1
+//	8K:                      0   0  35   |    2   0   1
+func readBrwStatsfile(ost string) BrwStats {
+	stats := make(BrwStats)
+	var f io.ReadCloser
+	var err error
+	for _, device := range brwDevices {
+		f, err = source.open(device, ost, "brw_stats")
+		if err == nil {
+			break
+		}
+	}
+	if err == nil {
+		r := bufio.NewReader(f)
+
+		var histogram BrwHistogram
+		line, isPrefix, err := r.ReadLine()
+		for err == nil && !isPrefix {
+			s := string(line)
+
+			halves := strings.SplitN(s, "|", 2)
+			if len(halves) == 2 {
+				read := strings.Fields(halves[0])
+				write := strings.Fields(halves[1])
+				if len(read) > 1 && strings.HasSuffix(read[0], ":") {
+					// bucket line of current histogram
+					if histogram != nil && len(write) > 0 {
+						var b BrwBucket
+						b.Read, _ = strconv.ParseInt(read[1], 10, 64)
+						b.Write, _ = strconv.ParseInt(write[0], 10, 64)
+						histogram[strings.TrimSuffix(read[0], ":")] = b
+					}
+				} else if len(read) > 3 {
+					// header line, name is followed by unit and "% cum %"
+					name := strings.Join(read[:len(read)-4], " ")
+					short, ok := brwHistograms[name]
+					if ok {
+						histogram = make(BrwHistogram)
+						stats[short] = histogram
+					} else {
+						histogram = nil
+					}
+				}
+			}
+			line, isPrefix, err = r.ReadLine()
+		}
+
+		f.Close()
+	}
+	return stats
+}
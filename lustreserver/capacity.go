@@ -0,0 +1,76 @@
+package lustreserver
+
+// capacity and inode usage of targets, changes slowly, so it is
+// not part of the performance values and can be fetched less often
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TargetCapacity gives size and free space of a target in kbytes and number of total and free inodes
+type TargetCapacity struct {
+	KBytesTotal, KBytesFree, FilesTotal, FilesFree int64
+}
+
+// CapacityValues contains capacity of each OST or MDT
+type CapacityValues struct {
+	Timestamp int32 // sample time of collector, will be overwritten by aggregator
+	Targets   map[string]TargetCapacity
+}
+
+// devices having the capacity files, newer lustre versions keep them in the osd only
+var capacityDevices = []string{"osd-ldiskfs", "osd-zfs"}
+
+// GetCapacity RPC call for OST, return capacity of all OSTs
+func (*OssRpcT) GetCapacity(arg int, result *CapacityValues) error {
+	if HasOST() {
+		*result = readCapacityValues("obdfilter", getOstlist())
+	}
+	return nil
+}
+
+// GetCapacity RPC call for MDS, return capacity of all MDTs
+func (*MdsRpcT) GetCapacity(arg int, result *CapacityValues) error {
+	if HasMDT() {
+		*result = readCapacityValues(mdtDevice, getMdtlist())
+	}
+	return nil
+}
+
+// read capacity of all targets, timestamp is time of reading
+func readCapacityValues(device string, targetlist []string) CapacityValues {
+	var values CapacityValues
+	values.Timestamp = int32(time.Now().Unix())
+	values.Targets = make(map[string]TargetCapacity)
+	devices := append([]string{device}, capacityDevices...)
+	for _, target := range targetlist {
+		var c TargetCapacity
+		c.KBytesTotal = readCapacityfile(devices, target, "kbytestotal")
+		c.KBytesFree = readCapacityfile(devices, target, "kbytesfree")
+		c.FilesTotal = readCapacityfile(devices, target, "filestotal")
+		c.FilesFree = readCapacityfile(devices, target, "filesfree")
+		values.Targets[target] = c
+	}
+	return values
+}
+
+// read a single number from file name of target, first device having it wins
+func readCapacityfile(devices []string, target, name string) int64 {
+	var v int64
+	for _, device := range devices {
+		f, err := source.open(device, target, name)
+		if err == nil {
+			r := bufio.NewReader(f)
+			line, _, err := r.ReadLine()
+			if err == nil {
+				v, _ = strconv.ParseInt(strings.TrimSpace(string(line)), 10, 64)
+			}
+			f.Close()
+			break
+		}
+	}
+	return v
+}
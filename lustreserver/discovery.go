@@ -0,0 +1,85 @@
+package lustreserver
+
+// discovery of exports, reading the exports directory of each target on
+// each call is expensive with thousands of clients, so the nids of each
+// target are cached and read again if the directory changed, if an export
+// disappeared or after exportRefresh at the latest (lctl and some kernels
+// do not give a usable mtime)
+
+import (
+	"sync"
+	"time"
+)
+
+// exports are read again at least after this time, change it with SetExportRefresh
+var exportRefresh = 60 * time.Second
+
+// exportCache keeps the selected nids having exports for each target of a device
+type exportCache struct {
+	sync.Mutex
+	device  string
+	nids    map[string][]string  // nids of each target
+	mtime   map[string]time.Time // mtime of exports directory of each target when read
+	refresh map[string]time.Time // time when exports of each target were read
+}
+
+// caches for OSTs and MDTs, used by getOstAndNidlist and getMdtAndNidlist
+var (
+	ostExports = new(exportCache)
+	mdtExports = new(exportCache)
+)
+
+// SetExportRefresh changes the maximum time exports of a target are cached
+func SetExportRefresh(d time.Duration) {
+	exportRefresh = d
+}
+
+// get nids of each target, exports are only read if they are not cached,
+// changed or too old, targets which are gone are forgotten
+func (c *exportCache) lookup(device string, targets []string) map[string][]string {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.device != device || c.nids == nil {
+		c.device = device
+		c.nids = make(map[string][]string)
+		c.mtime = make(map[string]time.Time)
+		c.refresh = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	result := make(map[string][]string)
+	for _, target := range targets {
+		mtime, hasMtime := source.exportsMtime(device, target)
+		last, ok := c.refresh[target]
+		if !ok || now.Sub(last) >= exportRefresh || (hasMtime && !mtime.Equal(c.mtime[target])) {
+			nids := []string{}
+			for _, nid := range source.exports(device, target) {
+				if nidSelected(nid) {
+					nids = append(nids, nid)
+				}
+			}
+			c.nids[target] = nids
+			c.mtime[target] = mtime
+			c.refresh[target] = now
+		}
+		result[target] = c.nids[target]
+	}
+
+	// forget targets which are gone, e.g. after failover
+	for target := range c.nids {
+		if _, ok := result[target]; !ok {
+			delete(c.nids, target)
+			delete(c.mtime, target)
+			delete(c.refresh, target)
+		}
+	}
+	return result
+}
+
+// read exports of target again on next lookup, e.g. as an export disappeared
+func (c *exportCache) invalidate(target string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.refresh, target)
+}
@@ -0,0 +1,87 @@
+package lustreserver
+
+// self monitoring of the collector, so the aggregator learns more about
+// a collector than whether it answers
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// BuildID and Hash describe the build of the collector, set by the collector,
+// which gets them with -ldflags "-X main.BuildID=... -X main.Hash=..."
+var (
+	BuildID string
+	Hash    string
+)
+
+// ScanStats describes the last reading of the stats files of all OSTs or MDTs
+type ScanStats struct {
+	Time       int32   // start of reading
+	Duration   float64 // time needed in seconds
+	Targets    int     // number of targets read
+	Exports    int     // number of exports read
+	Incomplete bool    // reading was stopped by the deadline
+}
+
+// Health gives state of the collector
+type Health struct {
+	BuildID, Hash string
+	Hostname      string
+	Uptime        int64 // seconds since start
+	LustreVersion string
+	IsOST, IsMDT  bool
+	OstScan       ScanStats
+	MdtScan       ScanStats
+	ReadErrors    int64  // stats files which could not be read since start
+	MemAlloc      uint64 // bytes of allocated heap objects
+	MemSys        uint64 // bytes of memory obtained from the OS
+	Goroutines    int
+}
+
+// scan statistics, protected by healthLock
+var (
+	healthLock sync.Mutex
+	startTime  = time.Now()
+	ostScan    ScanStats
+	mdtScan    ScanStats
+	readErrors int64
+)
+
+// Health RPC call returns state of the collector
+func (*ServerRpcT) Health(in int, result *Health) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	result.BuildID = BuildID
+	result.Hash = Hash
+	result.Hostname, _ = os.Hostname()
+	result.Uptime = int64(time.Since(startTime).Seconds())
+	result.LustreVersion = LustreVersion
+	result.IsOST = IsOST
+	result.IsMDT = IsMDT
+	result.MemAlloc = mem.Alloc
+	result.MemSys = mem.Sys
+	result.Goroutines = runtime.NumGoroutine()
+
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	result.OstScan = ostScan
+	result.MdtScan = mdtScan
+	result.ReadErrors = readErrors
+	return nil
+}
+
+// record a reading of stats files which started at start
+func recordScan(scan *ScanStats, start time.Time, targets, exports int, incomplete bool, failed int) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	scan.Time = int32(start.Unix())
+	scan.Duration = time.Since(start).Seconds()
+	scan.Targets = targets
+	scan.Exports = exports
+	scan.Incomplete = incomplete
+	readErrors += int64(failed)
+}
@@ -0,0 +1,193 @@
+package lustreserver
+
+// job_stats support, lustre servers account IO and metadata operations
+// for each jobid (if jobid_var is set on the clients), this allows
+// attribution of IO to jobs without mapping nids to jobs
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OstJobValues contains maps with values for each job for each OST
+type OstJobValues struct {
+	Timestamp int32 // sample time of collector, will be overwritten by aggregator
+	Delta     int32 // time difference
+	JobValues map[string]map[string]OstStats
+}
+
+// MdsJobValues contains maps with values for each job for each MDT
+type MdsJobValues struct {
+	Timestamp int32 // sample time of collector, will be overwritten by aggregator
+	Delta     int32 // time difference
+	JobValues map[string]map[string]OpStats
+}
+
+// one counter of a job in job_stats, number of samples and their sum
+type jobCounter struct {
+	samples, sum int64
+}
+
+// GetJobStatsDiff RPC call for OST, return job_stats counters which are not zero,
+// as difference to the last call within the session created with InitDiff
+func (*OssRpcT) GetJobStatsDiff(session int64, result *OstJobValues) error {
+	s, err := getOssSession(session)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if HasOST() {
+		current := readOstJobValues(getOstlist())
+		result.Timestamp = current.Timestamp
+		result.Delta = current.Timestamp - s.jobs.Timestamp
+		result.JobValues = make(map[string]map[string]OstStats)
+		for ost := range current.JobValues {
+			result.JobValues[ost] = make(map[string]OstStats)
+			for job, stats := range current.JobValues[ost] {
+				// a job missing in old values started IO since last call,
+				// so all its counters are new, same if counters were reset
+				diff := stats.sub(s.jobs.JobValues[ost][job])
+				if !diff.positive() {
+					diff = stats.sub(OstStats{})
+				}
+				if diff.nonzero() {
+					result.JobValues[ost][job] = diff
+				}
+			}
+		}
+		s.jobs = current
+	}
+	return nil
+}
+
+// GetJobStatsDiff RPC call for MDS, return job_stats counters which are not zero,
+// as difference to the last call within the session created with InitDiff
+func (*MdsRpcT) GetJobStatsDiff(session int64, result *MdsJobValues) error {
+	s, err := getMdsSession(session)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if HasMDT() {
+		current := readMdsJobValues(getMdtlist())
+		result.Timestamp = current.Timestamp
+		result.Delta = current.Timestamp - s.jobs.Timestamp
+		result.JobValues = make(map[string]map[string]OpStats)
+		for mdt := range current.JobValues {
+			result.JobValues[mdt] = make(map[string]OpStats)
+			for job, ops := range current.JobValues[mdt] {
+				// a job missing in old values started IO since last call,
+				// so all its counters are new, same if counters were reset
+				diff := ops.sub(s.jobs.JobValues[mdt][job])
+				if !diff.positive() {
+					diff = ops.sub(nil)
+				}
+				if diff.nonzero() {
+					result.JobValues[mdt][job] = diff
+				}
+			}
+		}
+		s.jobs = current
+	}
+	return nil
+}
+
+// read job_stats of all OSTs, timestamp is time of reading
+func readOstJobValues(ostlist []string) OstJobValues {
+	var values OstJobValues
+	values.Timestamp = int32(time.Now().Unix())
+	values.JobValues = make(map[string]map[string]OstStats)
+	for _, ost := range ostlist {
+		values.JobValues[ost] = make(map[string]OstStats)
+		for job, counters := range readJobStatsfile("obdfilter", ost) {
+			var stats OstStats
+			stats.RRqs = counters["read_bytes"].samples
+			stats.RBs = counters["read_bytes"].sum
+			stats.WRqs = counters["write_bytes"].samples
+			stats.WBs = counters["write_bytes"].sum
+			stats.Ops = make(OpStats)
+			for op, c := range counters {
+				if op != "read_bytes" && op != "write_bytes" {
+					stats.Ops[op] = c.samples
+				}
+			}
+			values.JobValues[ost][job] = stats
+		}
+	}
+	return values
+}
+
+// read job_stats of all MDTs, timestamp is time of reading
+func readMdsJobValues(mdtlist []string) MdsJobValues {
+	var values MdsJobValues
+	values.Timestamp = int32(time.Now().Unix())
+	values.JobValues = make(map[string]map[string]OpStats)
+	for _, mdt := range mdtlist {
+		values.JobValues[mdt] = make(map[string]OpStats)
+		for job, counters := range readJobStatsfile(mdtDevice, mdt) {
+			ops := make(OpStats)
+			for op, c := range counters {
+				ops[op] = c.samples
+			}
+			values.JobValues[mdt][job] = ops
+		}
+	}
+	return values
+}
+
+// read job_stats of a target, return counters for each job
+// format is YAML like:
+//
+//	job_stats:
+//	- job_id:          dd.0
+//	  snapshot_time:   1352084992
+//	  read_bytes:      { samples:           0, unit: bytes, min:       0, max:       0, sum:               0 }
+//	  open:            { samples:           2, unit:  reqs }
+func readJobStatsfile(device, target string) map[string]map[string]jobCounter {
+	jobs := make(map[string]map[string]jobCounter)
+	f, err := source.open(device, target, "job_stats")
+	if err == nil {
+		r := bufio.NewReader(f)
+
+		var job string
+		line, isPrefix, err := r.ReadLine()
+		for err == nil && !isPrefix {
+			s := strings.TrimSpace(string(line))
+
+			if strings.HasPrefix(s, "- job_id:") {
+				job = strings.TrimSpace(strings.TrimPrefix(s, "- job_id:"))
+				jobs[job] = make(map[string]jobCounter)
+			} else if job != "" && strings.HasSuffix(s, "}") {
+				colon := strings.Index(s, ":")
+				open := strings.Index(s, "{")
+				if colon > 0 && open > colon {
+					var c jobCounter
+					name := s[:colon]
+					for _, kv := range strings.Split(strings.Trim(s[open:], "{} "), ",") {
+						pair := strings.SplitN(kv, ":", 2)
+						if len(pair) != 2 {
+							continue
+						}
+						switch strings.TrimSpace(pair[0]) {
+						case "samples":
+							c.samples, _ = strconv.ParseInt(strings.TrimSpace(pair[1]), 10, 64)
+						case "sum":
+							c.sum, _ = strconv.ParseInt(strings.TrimSpace(pair[1]), 10, 64)
+						}
+					}
+					jobs[job][name] = c
+				}
+			}
+			line, isPrefix, err = r.ReadLine()
+		}
+
+		f.Close()
+	}
+	return jobs
+}
@@ -0,0 +1,77 @@
+package lustreserver
+
+// service times of operations, lustre stats files keep min, max, sum and
+// sum of squares for timed operations (unit usec or usecs), which gives
+// average service time per interval from differences of sum and samples
+
+import (
+	"strconv"
+)
+
+// OpTiming gives number of samples, sum and sum of squares of service times in usecs,
+// and the maximum service time since counters were cleared, as lustre has no maximum per interval,
+// in differences it is only set if the maximum grew in the interval
+type OpTiming struct {
+	Samples, Sum, Sumsq, Max int64
+}
+
+// OpTimes gives service times for each timed operation, named as in lustre stats files
+type OpTimes map[string]OpTiming
+
+// Avg returns average service time in usecs
+func (a OpTiming) Avg() float64 {
+	if a.Samples == 0 {
+		return 0.0
+	}
+	return float64(a.Sum) / float64(a.Samples)
+}
+
+// subtract b from a, operations without new samples are omitted,
+// maximum is the one of a, if it is larger than the one of b it happened in between,
+// otherwise it is not known and 0, operations missing in a were reset and give a
+// negative difference
+func (a OpTimes) sub(b OpTimes) OpTimes {
+	result := make(OpTimes)
+	for op, v := range a {
+		old := b[op]
+		if d := v.Samples - old.Samples; d != 0 {
+			max := int64(0)
+			if v.Max > old.Max {
+				max = v.Max
+			}
+			result[op] = OpTiming{d, v.Sum - old.Sum, v.Sumsq - old.Sumsq, max}
+		}
+	}
+	for op, v := range b {
+		if _, ok := a[op]; !ok && v.Samples != 0 {
+			result[op] = OpTiming{-v.Samples, -v.Sum, -v.Sumsq, 0}
+		}
+	}
+	return result
+}
+
+// check for positive values
+func (a OpTimes) positive() bool {
+	for _, v := range a {
+		if v.Samples < 0 || v.Sum < 0 || v.Sumsq < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parse timing of a stats line split into fields, for timed operations only
+// format is: name count samples [usec] min max sum and, in newer versions, sumsq
+func parseTiming(fields []string) (OpTiming, bool) {
+	var t OpTiming
+	if len(fields) < 7 || fields[2] != "samples" || (fields[3] != "[usec]" && fields[3] != "[usecs]") {
+		return t, false
+	}
+	t.Samples, _ = strconv.ParseInt(fields[1], 10, 64)
+	t.Max, _ = strconv.ParseInt(fields[5], 10, 64)
+	t.Sum, _ = strconv.ParseInt(fields[6], 10, 64)
+	if len(fields) > 7 {
+		t.Sumsq, _ = strconv.ParseInt(fields[7], 10, 64)
+	}
+	return t, true
+}
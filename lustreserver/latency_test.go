@@ -0,0 +1,24 @@
+package lustreserver
+
+import (
+	"testing"
+)
+
+// differences give the maximum only if it grew in the interval, and negative values after a reset
+func TestOpTimesSub(t *testing.T) {
+	old := OpTimes{"open": {10, 1000, 200000, 400}, "close": {10, 100, 1000, 20}, "unlink": {5, 50, 500, 10}}
+	cur := OpTimes{"open": {20, 1500, 250000, 400}, "close": {30, 400, 6000, 50}}
+	diff := cur.sub(old)
+	if d := diff["open"]; d != (OpTiming{10, 500, 50000, 0}) {
+		t.Errorf("open: difference %v, old maximum counted", d)
+	}
+	if d := diff["close"]; d != (OpTiming{20, 300, 5000, 50}) {
+		t.Errorf("close: difference %v", d)
+	}
+	if d := diff["unlink"]; d.Samples != -5 || diff.positive() {
+		t.Errorf("unlink: difference %v, missing operation not negative", d)
+	}
+	if d := cur.sub(nil)["open"]; d != cur["open"] {
+		t.Errorf("open: difference to nothing %v", d)
+	}
+}
@@ -1,77 +1,68 @@
 // Package lustreserver exposes oss and mds performance counters over rpc
 // this includes for OSS number of read and write requests and number of bytes
-// written and read
-// for MDT it delivers total number of requests only (to be extended and precised
-// down to single requests)
+// written and read, and number of requests of other operations like punch or sync
+// and service times of timed operations
+// for MDT it delivers number of requests and service times for each metadata operation
+// both offer difference mode (for a single consumer like the aggregator)
+// and absolute mode (raw counters, for any consumer computing its own rates)
 // TODO
 //  fix mds for differences
-//  offer difference + absolute mode for OST as for MDS
 //	offer inquire rpc function if mdt or ost
 package lustreserver
 
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"log"
-	"math/rand"
-	"net"
 	"net/rpc"
-	"os"
 	//	"runtime/pprof"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// path to lustre proc (used for testing, should start with / for production!!)
-const Procdir = "/proc/fs/lustre/"
+// Procdir is the path to lustre proc, change it with SetProcdir
+// (used for testing, should start with / for production!!)
+var Procdir = "/proc/fs/lustre/"
 
-const ostprocpath = Procdir + "obdfilter/"
-
-// different lustre versions have different locations for performance files
-var mdtprocpath = map[string]string{
-	"1.8": "/proc/fs/lustre/mds",
-	"2.5": "/proc/fs/lustre/mdt",
-}
-var mdtstatname = map[string]string{
-	"1.8": "/stats",
-	"2.5": "/md_stats",
-}
-
-// real pathnames after check with exists
-var realmdtprocpath string
-var realstatname string
-
-// OstStats gives write and read requests and bytes read and written
+// OstStats gives write and read requests and bytes read and written,
+// and number of requests of all other operations (like punch, setattr or sync)
+// and service times of timed operations
 type OstStats struct {
 	WRqs, WBs, RRqs, RBs int64
+	Ops                  OpStats
+	Times                OpTimes
 }
 
+// OpStats gives number of requests for each operation, named as in lustre stats files
+type OpStats map[string]int64
+
 // MdsValues contains maps with total values for each MDT and for values each nid for each MDT
 type MdsValues struct {
-	Timestamp int32 // will be filled by aggregator and is used to transfer difference
-	Delta     int32 // time difference
-	MdsTotal  map[string]int64
-	NidValues map[string]map[string]int64
+	Timestamp  int32 // sample time of collector, will be overwritten by aggregator
+	Delta      int32 // time difference
+	MdsTotal   map[string]OpStats
+	NidValues  map[string]map[string]OpStats
+	TotalTimes map[string]OpTimes            // service times for each MDT
+	NidTimes   map[string]map[string]OpTimes // service times for each nid for each MDT
+	Reset      map[string]bool               // MDTs where counters were reset or are new since last difference
+	Incomplete bool                          // not all files could be read in time, values are missing
+	failed     int                           // files which could not be read, values are missing
+	unread     map[statsFile]bool            // files of targets and nids without values, no baseline for differences
 }
 
 // OstValues contains maps with total values for each OST and for values for each nid for each OST
 type OstValues struct {
-	Timestamp int32 // will be filled by aggregator
-	Delta     int32 // time difference
-	OstTotal  map[string]OstStats
-	NidValues map[string]map[string]OstStats
+	Timestamp  int32 // sample time of collector, will be overwritten by aggregator
+	Delta      int32 // time difference
+	OstTotal   map[string]OstStats
+	NidValues  map[string]map[string]OstStats
+	Reset      map[string]bool    // OSTs where counters were reset or are new since last difference
+	Incomplete bool               // not all files could be read in time, values are missing
+	failed     int                // files which could not be read, values are missing
+	unread     map[statsFile]bool // files of targets and nids without values, no baseline for differences
 }
 
-// new and old ostvalues to build difference
-var (
-	ostvalues [2]OstValues
-	mdsvalues [2]MdsValues
-	oldpos    int = 0
-	newpos    int = 1
-)
-
 // flags to show status
 var (
 	IsOST bool
@@ -94,12 +85,14 @@ func (a OstStats) sub(b OstStats) OstStats {
 	result.RRqs = a.RRqs - b.RRqs
 	result.WBs = a.WBs - b.WBs
 	result.RBs = a.RBs - b.RBs
+	result.Ops = a.Ops.sub(b.Ops)
+	result.Times = a.Times.sub(b.Times)
 	return result
 }
 
 // check for zero
 func (a OstStats) nonzero() bool {
-	if (a.WRqs == 0) && (a.RRqs == 0) && (a.WBs == 0) && (a.RBs == 0) {
+	if (a.WRqs == 0) && (a.RRqs == 0) && (a.WBs == 0) && (a.RBs == 0) && !a.Ops.nonzero() {
 		return false
 	}
 	return true
@@ -107,12 +100,68 @@ func (a OstStats) nonzero() bool {
 
 // check for positive values
 func (a OstStats) positive() bool {
-	if (a.WRqs < 0) || (a.RRqs < 0) || (a.WBs < 0) || (a.RBs < 0) {
+	if (a.WRqs < 0) || (a.RRqs < 0) || (a.WBs < 0) || (a.RBs < 0) || !a.Ops.positive() || !a.Times.positive() {
 		return false
 	}
 	return true
 }
 
+// subtract b from a, operations with zero difference are omitted,
+// operations missing in a were reset (stats files omit zero counters)
+// and give a negative difference
+func (a OpStats) sub(b OpStats) OpStats {
+	result := make(OpStats)
+	for op, v := range a {
+		if d := v - b[op]; d != 0 {
+			result[op] = d
+		}
+	}
+	for op, v := range b {
+		if _, ok := a[op]; !ok && v != 0 {
+			result[op] = -v
+		}
+	}
+	return result
+}
+
+// check for zero
+func (a OpStats) nonzero() bool {
+	for _, v := range a {
+		if v != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// check for positive values
+func (a OpStats) positive() bool {
+	for _, v := range a {
+		if v < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Total returns the sum of requests over all operations
+func (a OpStats) Total() int64 {
+	var total int64
+	for _, v := range a {
+		total += v
+	}
+	return total
+}
+
+// SetProcdir changes the root of the lustre proc tree, e.g. to read a recorded
+// snapshot, empty to not use it, has to be called before SetSource
+func SetProcdir(dir string) {
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir = dir + "/"
+	}
+	Procdir = dir
+}
+
 // MakeServerRPC register RPC server for inquiries like OST/MDT
 func MakeServerRPC() {
 	server := new(ServerRpcT)
@@ -121,30 +170,8 @@ func MakeServerRPC() {
 
 // MakeMdsRPC registers RPC server for MDS
 func MakeMdsRPC() {
-	var ok bool
 	mds := new(MdsRpcT)
 	rpc.Register(mds)
-
-	f, err := os.Open("/proc/fs/lustre/version")
-	if err == nil {
-		r := bufio.NewReader(f)
-
-		line, _, err := r.ReadLine()
-		if err == nil {
-			version := strings.Fields(string(line))[1][:3]
-			fmt.Println("lustre version", version)
-			realmdtprocpath, ok = mdtprocpath[version]
-			if !ok {
-				fmt.Println("unknown lustre version", version)
-			}
-			realstatname, ok = mdtstatname[version]
-		} else {
-			log.Panic("could not read lustre version file!")
-		}
-	} else {
-		log.Panic("no lustre version file found!")
-	}
-	f.Close()
 }
 
 // MakeOssRPC registers RPC server for OSS
@@ -153,9 +180,10 @@ func MakeOssRPC() {
 	rpc.Register(oss)
 }
 
-// StartServer starts the HTTP RPC server
-func StartServer() {
-	l, e := net.Listen("tcp", "0.0.0.0:1234") // FIXME get port from config file
+// StartServer starts the RPC server on address, in form host:port,
+// with TLS if enabled with SetServerTLS
+func StartServer(address string) {
+	l, e := Listen(address, serverTLS)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
@@ -176,38 +204,9 @@ func (*ServerRpcT) IsMDT(in int, result *bool) error {
 	return nil
 }
 
-// GetRandomValues RPC call for OST, returns random values for testing
-func (*OssRpcT) GetRandomValues(init bool, result *OstValues) error {
-	result.OstTotal = make(map[string]OstStats)
-	result.NidValues = make(map[string]map[string]OstStats)
-
-	for i := 0; i < 10; i++ {
-		ost := "OST" + strconv.Itoa(int(rand.Int63n(10)))
-
-		t := result.OstTotal[ost]
-		t.RBs = rand.Int63n(10)
-		t.WBs = rand.Int63n(10)
-		t.RRqs = rand.Int63n(100)
-		t.WRqs = rand.Int63n(100)
-		result.OstTotal[ost] = t
-
-		result.NidValues[ost] = make(map[string]OstStats)
-		for j := 0; j < 100; j++ {
-			nid := "nid" + strconv.Itoa(int(rand.Int63n(100)))
-			t := result.NidValues[ost][nid]
-			t.RBs = rand.Int63n(10)
-			t.WBs = rand.Int63n(10)
-			t.RRqs = rand.Int63n(100)
-			t.WRqs = rand.Int63n(100)
-			result.NidValues[ost][nid] = t
-		}
-	}
-	return nil
-}
-
-// GetValuesDiff RPC call for OST, return all performance counters which are not zero
-// FIXME no absolute version yet
-func (*OssRpcT) GetValuesDiff(init bool, result *OstValues) error {
+// GetValuesDiff RPC call for OST, return all performance counters which are not zero,
+// as difference to the last call within the session created with InitDiff
+func (*OssRpcT) GetValuesDiff(session int64, result *OstValues) error {
 	//fmt.Printf("RPC oss\n")
 
 	/* PROFILING CODE
@@ -218,66 +217,22 @@ func (*OssRpcT) GetValuesDiff(init bool, result *OstValues) error {
 	pprof.StartCPUProfile(pf)
 	*/
 
-	var last, now int32
-	if _, err := os.Stat(Procdir + "ost"); err == nil {
-		if init {
-			// we init old and new once to have both, as they cycle, otherwise panic
-			ostvalues[newpos].OstTotal = make(map[string]OstStats)
-			ostvalues[newpos].NidValues = make(map[string]map[string]OstStats)
-			ostvalues[oldpos].OstTotal = make(map[string]OstStats)
-			ostvalues[oldpos].NidValues = make(map[string]map[string]OstStats)
-			ostvalues[oldpos].Timestamp = int32(time.Now().Unix())
-		}
-
-		// get values
-		now = int32(time.Now().Unix())
-		ostvalues[newpos].Timestamp = int32(now)
-		ostlist, nidSet := getOstAndNidlist()
-		for _, ost := range ostlist {
-			ostvalues[newpos].OstTotal[ost] = readOstStatfile(ostprocpath + ost + "/stats")
-			ostvalues[newpos].NidValues[ost] = make(map[string]OstStats)
-			for nid := range nidSet {
-				ostvalues[newpos].NidValues[ost][nid] = readOstStatfile(ostprocpath + ost + "/exports/" + nid + "/stats")
-			}
-		}
-
-		// if not init, subtract and assign return values
-		if !init {
-			result.OstTotal = make(map[string]OstStats)
-			result.NidValues = make(map[string]map[string]OstStats)
-
-			// we check for nonzero and positive
-			// non positive values could show up when counters overflow
-			// zero values are ommited for space reasons
-
-			for _, ost := range ostlist {
-				result.NidValues[ost] = make(map[string]OstStats)
-				_, ok := ostvalues[oldpos].OstTotal[ost]
-				if !ok {
-					continue // old value does not exist, we skip this one
-					// this happens e.g. after a OST failover
-				}
-				diff := ostvalues[newpos].OstTotal[ost].sub(ostvalues[oldpos].OstTotal[ost])
-				if diff.nonzero() && diff.positive() {
-					result.OstTotal[ost] = diff
-					last = ostvalues[oldpos].Timestamp
-					result.Delta = int32(now - last)
-					for nid := range nidSet {
-						_, ok := (ostvalues[oldpos].NidValues[ost][nid])
-						if !ok {
-							continue // old value does not exist, we skip this one
-							// this happens e.g. after a OST failover, or when a NID issues first IO
-						}
-						diff := ostvalues[newpos].NidValues[ost][nid].sub(ostvalues[oldpos].NidValues[ost][nid])
-						if diff.nonzero() && diff.positive() {
-							result.NidValues[ost][nid] = diff
-						}
-					}
-				}
-			}
+	s, err := getOssSession(session)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if HasOST() {
+		current := readOstValues(getOstAndNidlist())
+		*result = diffOstValues(s.values, current)
+		truncateOstNids(result)
+		if current.Incomplete || current.failed > 0 {
+			// what was not read is counted in the next difference
+			current = keepOstValues(s.values, current)
 		}
-		newpos = (newpos + 1) % 2
-		oldpos = (oldpos + 1) % 2
+		s.values = current
 	} /* else {
 		return errors.New("this is no ost")
 	} */
@@ -288,87 +243,166 @@ func (*OssRpcT) GetValuesDiff(init bool, result *OstValues) error {
 	return nil
 }
 
-// GetValuesDiff RPC call for MDS, return counters which are not zero
-func (*MdsRpcT) GetValuesDiff(init bool, result *MdsValues) error {
+// GetValuesDiff RPC call for MDS, return counters which are not zero,
+// as difference to the last call within the session created with InitDiff
+func (*MdsRpcT) GetValuesDiff(session int64, result *MdsValues) error {
 	// fmt.Printf("RPC mds\n")
-	var last, now int32
-	if _, err := os.Stat(Procdir + "mds"); err == nil {
-		if init {
-			mdsvalues[newpos].MdsTotal = make(map[string]int64)
-			mdsvalues[newpos].NidValues = make(map[string]map[string]int64)
-			mdsvalues[oldpos].MdsTotal = make(map[string]int64)
-			mdsvalues[oldpos].NidValues = make(map[string]map[string]int64)
-			mdsvalues[oldpos].Timestamp = int32(time.Now().Unix())
+	s, err := getMdsSession(session)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if HasMDT() {
+		current := readMdsValues(getMdtAndNidlist())
+		*result = diffMdsValues(s.values, current)
+		truncateMdsNids(result)
+		if current.Incomplete || current.failed > 0 {
+			// what was not read is counted in the next difference
+			current = keepMdsValues(s.values, current)
 		}
+		s.values = current
+	} /*else {
+		return errors.New("no mdt")
+	} */
+	// fmt.Printf("RPC result %v\n", result)
+	return nil
+}
 
-		now = int32(time.Now().Unix())
-		mdsvalues[newpos].Timestamp = int32(now)
-		mdslist, nidSet := getMdtAndNidlist()
-		for _, mds := range mdslist {
-			mdsvalues[newpos].MdsTotal[mds] = readMdsStatfile(realmdtprocpath + "/" + mds + realstatname)
-			mdsvalues[newpos].NidValues[mds] = make(map[string]int64)
-			for nid := range nidSet {
-				mdsvalues[newpos].NidValues[mds][nid] = readMdsStatfile(realmdtprocpath + "/" + mds + "/exports/" + nid + "/stats")
-			}
-		}
+// build difference of OST values, only values which are not zero are returned
+// counters which went backwards (stats clear, export reconnect, wraparound) or
+// are new (failover, first IO of a nid) count from zero, so their absolute value
+// is the difference, targets whose own counters went backwards or which are new
+// are flagged in Reset, new or reconnected nids are not, their zero baseline
+// is right, as a new export starts counting from zero. targets and nids which
+// were listed but not read for old have no baseline and no difference
+func diffOstValues(old, current OstValues) OstValues {
+	var result OstValues
+	result.Timestamp = current.Timestamp
+	result.Delta = current.Timestamp - old.Timestamp
+	result.Incomplete = current.Incomplete
+	result.OstTotal = make(map[string]OstStats)
+	result.NidValues = make(map[string]map[string]OstStats)
+	result.Reset = make(map[string]bool)
 
-		if !init {
-			result.MdsTotal = make(map[string]int64)
-			result.NidValues = make(map[string]map[string]int64)
+	// zero values are ommited for space reasons
 
-			// we do not send zero and values < 0, for compression reasons
-			// and as negative values indicate error conditions like counter overrun
+	for ost := range current.OstTotal {
+		oldtotal, ok := old.OstTotal[ost]
+		if !ok && old.unread[statsFile{ost, ""}] {
+			// not read before, e.g. for the first snapshot of a session,
+			// no baseline yet, this is the baseline for the next difference
+			continue
+		}
+		result.NidValues[ost] = make(map[string]OstStats)
+		diff := current.OstTotal[ost].sub(oldtotal)
+		if !ok || !diff.positive() {
+			// old value does not exist, e.g. after a OST failover,
+			// or counters were reset
+			diff = current.OstTotal[ost].sub(OstStats{})
+			result.Reset[ost] = true
+		}
+		if diff.nonzero() {
+			result.OstTotal[ost] = diff
+			for nid := range current.NidValues[ost] {
+				oldnid, ok := old.NidValues[ost][nid]
+				if !ok && old.unread[statsFile{ost, nid}] {
+					continue
+				}
+				diff := current.NidValues[ost][nid].sub(oldnid)
+				if !ok || !diff.positive() {
+					// old value does not exist, e.g. when a NID issues first IO,
+					// or export was reconnected
+					diff = current.NidValues[ost][nid].sub(OstStats{})
+				}
+				if diff.nonzero() {
+					result.NidValues[ost][nid] = diff
+				}
+			}
+		}
+	}
+	return result
+}
 
-			for _, mds := range mdslist {
-				result.NidValues[mds] = make(map[string]int64)
-				_, ok := mdsvalues[oldpos].MdsTotal[mds]
-				if !ok {
-					continue // we skip this one as no old value is available, e.g. after failover
+// build difference of MDS values, only values which are not zero are returned,
+// resets are handled like in diffOstValues
+func diffMdsValues(old, current MdsValues) MdsValues {
+	var result MdsValues
+	result.Timestamp = current.Timestamp
+	result.Delta = current.Timestamp - old.Timestamp
+	result.Incomplete = current.Incomplete
+	result.MdsTotal = make(map[string]OpStats)
+	result.NidValues = make(map[string]map[string]OpStats)
+	result.TotalTimes = make(map[string]OpTimes)
+	result.NidTimes = make(map[string]map[string]OpTimes)
+	result.Reset = make(map[string]bool)
+
+	// we do not send zero values, for compression reasons
+
+	for mds := range current.MdsTotal {
+		oldtotal, ok := old.MdsTotal[mds]
+		if !ok && old.unread[statsFile{mds, ""}] {
+			// not read before, no baseline yet
+			continue
+		}
+		result.NidValues[mds] = make(map[string]OpStats)
+		result.NidTimes[mds] = make(map[string]OpTimes)
+		diff := current.MdsTotal[mds].sub(oldtotal)
+		times := current.TotalTimes[mds].sub(old.TotalTimes[mds])
+		if !ok || !diff.positive() || !times.positive() {
+			// old value does not exist, e.g. after failover, or counters were reset
+			diff = current.MdsTotal[mds].sub(nil)
+			times = current.TotalTimes[mds].sub(nil)
+			result.Reset[mds] = true
+		}
+		if diff.nonzero() {
+			result.MdsTotal[mds] = diff
+			if len(times) > 0 {
+				result.TotalTimes[mds] = times
+			}
+			for nid := range current.NidValues[mds] {
+				oldnid, ok := old.NidValues[mds][nid]
+				if !ok && old.unread[statsFile{mds, nid}] {
+					continue
 				}
-				diff := mdsvalues[newpos].MdsTotal[mds] - mdsvalues[oldpos].MdsTotal[mds]
-				if diff > 0 {
-					result.MdsTotal[mds] = diff
-					last = mdsvalues[oldpos].Timestamp
-					result.Delta = int32(now - last)
-					for nid := range nidSet {
-						_, ok := mdsvalues[oldpos].NidValues[mds][nid]
-						if !ok {
-							continue // we skip this one as no old value is available, e.g. after failover
-						}
-						diff := mdsvalues[newpos].NidValues[mds][nid] - mdsvalues[oldpos].NidValues[mds][nid]
-						if diff > 0 {
-							result.NidValues[mds][nid] = diff
-						}
+				diff := current.NidValues[mds][nid].sub(oldnid)
+				times := current.NidTimes[mds][nid].sub(old.NidTimes[mds][nid])
+				if !ok || !diff.positive() || !times.positive() {
+					// old value does not exist, e.g. first request of a nid,
+					// or export was reconnected
+					diff = current.NidValues[mds][nid].sub(nil)
+					times = current.NidTimes[mds][nid].sub(nil)
+				}
+				if diff.nonzero() {
+					result.NidValues[mds][nid] = diff
+					if len(times) > 0 {
+						result.NidTimes[mds][nid] = times
 					}
 				}
 			}
-
 		}
-		newpos = (newpos + 1) % 2
-		oldpos = (oldpos + 1) % 2
-		last = now
-	} /*else {
-		return errors.New("no mdt")
-	} */
-	// fmt.Printf("RPC result %v\n", result)
+	}
+	return result
+}
+
+// GetValues RPC call for OST, return all performance counters as absolute values,
+// with sample time of collector, can be used by any number of consumers
+func (*OssRpcT) GetValues(arg int, result *OstValues) error {
+	if HasOST() {
+		*result = readOstValues(getOstAndNidlist())
+	} else {
+		return errors.New("no ost")
+	}
 	return nil
 }
 
-// GetValues RPC call for OST, return all performance counters
+// GetValues RPC call for MDS, return all performance counters as absolute values,
+// with sample time of collector, can be used by any number of consumers
 func (*MdsRpcT) GetValues(arg int, result *MdsValues) error {
 	// fmt.Printf("RPC mds\n")
-	if _, err := os.Stat(Procdir + "mds"); err == nil {
-		result.MdsTotal = make(map[string]int64)
-		result.NidValues = make(map[string]map[string]int64)
-
-		mdslist, nidSet := getMdtAndNidlist()
-		for _, mds := range mdslist {
-			result.MdsTotal[mds] = readMdsStatfile(realmdtprocpath + "/" + mds + "/stats")
-			result.NidValues[mds] = make(map[string]int64)
-			for nid := range nidSet {
-				result.NidValues[mds][nid] = readMdsStatfile(realmdtprocpath + "/" + mds + "/exports/" + nid + "/stats")
-			}
-		}
+	if HasMDT() {
+		*result = readMdsValues(getMdtAndNidlist())
 	} else {
 		return errors.New("no mdt")
 	}
@@ -376,10 +410,151 @@ func (*MdsRpcT) GetValues(arg int, result *MdsValues) error {
 	return nil
 }
 
-// read OST performance values from file, return struct with all 64bit values
-func readOstStatfile(filename string) OstStats {
+// a stats file to read, nid is empty for the stats of the target itself
+type statsFile struct {
+	target, nid string
+}
+
+// list of stats files of all targets and their nids
+func statsFiles(targetlist []string, nids map[string][]string) []statsFile {
+	files := []statsFile{}
+	for _, target := range targetlist {
+		files = append(files, statsFile{target, ""})
+		for _, nid := range nids[target] {
+			files = append(files, statsFile{target, nid})
+		}
+	}
+	return files
+}
+
+// result of reading an OST stats file
+type ostStatsResult struct {
+	stats OstStats
+	err   error
+}
+
+// result of reading an MDT stats file
+type mdsStatsResult struct {
+	ops   OpStats
+	times OpTimes
+	err   error
+}
+
+// read all counters of all OSTs and their nids, timestamp is time of reading,
+// files are read in parallel, values not read in time or with errors are missing,
+// nids of targets which are missing are missing as well
+func readOstValues(ostlist []string, nids map[string][]string) OstValues {
+	var values OstValues
+	start := time.Now()
+	values.Timestamp = int32(start.Unix())
+	values.OstTotal = make(map[string]OstStats)
+	values.NidValues = make(map[string]map[string]OstStats)
+	values.unread = make(map[statsFile]bool)
+
+	files := statsFiles(ostlist, nids)
+	results, complete := readParallel(len(files), func(i int) interface{} {
+		name := "stats"
+		if files[i].nid != "" {
+			name = "exports/" + files[i].nid + "/stats"
+		}
+		stats, err := readOstStatfile(files[i].target, name)
+		return ostStatsResult{stats, err}
+	})
+	values.Incomplete = !complete
+
+	failed := 0
+	for i, f := range files {
+		if results[i] == nil {
+			values.unread[f] = true
+			continue
+		}
+		r := results[i].(ostStatsResult)
+		if r.err != nil {
+			failed++
+		}
+		if f.nid == "" {
+			if r.err != nil {
+				values.unread[f] = true
+				continue
+			}
+			values.OstTotal[f.target] = r.stats
+			values.NidValues[f.target] = make(map[string]OstStats)
+		} else if r.err != nil {
+			// export is gone, discover exports again next time
+			ostExports.invalidate(f.target)
+		} else if values.NidValues[f.target] != nil {
+			values.NidValues[f.target][f.nid] = r.stats
+		}
+	}
+	values.failed = failed
+	recordScan(&ostScan, start, len(ostlist), len(files)-len(ostlist), values.Incomplete, failed)
+	return values
+}
+
+// read all counters of all MDTs and their nids, timestamp is time of reading,
+// files are read in parallel, values not read in time or with errors are missing,
+// nids of targets which are missing are missing as well
+func readMdsValues(mdslist []string, nids map[string][]string) MdsValues {
+	var values MdsValues
+	start := time.Now()
+	values.Timestamp = int32(start.Unix())
+	values.MdsTotal = make(map[string]OpStats)
+	values.NidValues = make(map[string]map[string]OpStats)
+	values.TotalTimes = make(map[string]OpTimes)
+	values.NidTimes = make(map[string]map[string]OpTimes)
+	values.unread = make(map[statsFile]bool)
+
+	files := statsFiles(mdslist, nids)
+	results, complete := readParallel(len(files), func(i int) interface{} {
+		name := mdtStatname
+		if files[i].nid != "" {
+			name = "exports/" + files[i].nid + "/stats"
+		}
+		ops, times, err := readMdsStatfile(files[i].target, name)
+		return mdsStatsResult{ops, times, err}
+	})
+	values.Incomplete = !complete
+
+	failed := 0
+	for i, f := range files {
+		if results[i] == nil {
+			values.unread[f] = true
+			continue
+		}
+		r := results[i].(mdsStatsResult)
+		if r.err != nil {
+			failed++
+		}
+		if f.nid == "" {
+			if r.err != nil {
+				values.unread[f] = true
+				continue
+			}
+			values.MdsTotal[f.target] = r.ops
+			values.TotalTimes[f.target] = r.times
+			values.NidValues[f.target] = make(map[string]OpStats)
+			values.NidTimes[f.target] = make(map[string]OpTimes)
+		} else if r.err != nil {
+			// export is gone, discover exports again next time
+			mdtExports.invalidate(f.target)
+		} else if values.NidValues[f.target] != nil {
+			values.NidValues[f.target][f.nid] = r.ops
+			values.NidTimes[f.target][f.nid] = r.times
+		}
+	}
+	values.failed = failed
+	recordScan(&mdtScan, start, len(mdslist), len(files)-len(mdslist), values.Incomplete, failed)
+	return values
+}
+
+// read OST performance values of a target from stats file name,
+// return struct with all 64bit values, error if file could not be opened
+func readOstStatfile(ost, name string) (OstStats, error) {
 	var stats OstStats
-	f, err := os.Open(filename)
+	stats.Ops = make(OpStats)
+	stats.Times = make(OpTimes)
+	var v int64
+	f, err := source.open("obdfilter", ost, name)
 	if err == nil {
 		r := bufio.NewReader(f)
 
@@ -387,16 +562,29 @@ func readOstStatfile(filename string) OstStats {
 		for err == nil && !isPrefix {
 			s := string(line)
 
+			// format is: name count samples [unit] min max sum and, in newer versions, sumsq
 			if strings.HasPrefix(s, "read_bytes") {
 				fields := strings.Fields(s)
-				nr := len(fields)
-				stats.RBs, _ = strconv.ParseInt(fields[nr-1], 10, 64)
-				stats.RRqs, _ = strconv.ParseInt(fields[nr-6], 10, 64)
+				if len(fields) > 6 {
+					stats.RBs, _ = strconv.ParseInt(fields[6], 10, 64)
+					stats.RRqs, _ = strconv.ParseInt(fields[1], 10, 64)
+				}
 			} else if strings.HasPrefix(s, "write_bytes") {
 				fields := strings.Fields(s)
-				nr := len(fields)
-				stats.WBs, _ = strconv.ParseInt(fields[nr-1], 10, 64)
-				stats.WRqs, _ = strconv.ParseInt(fields[nr-6], 10, 64)
+				if len(fields) > 6 {
+					stats.WBs, _ = strconv.ParseInt(fields[6], 10, 64)
+					stats.WRqs, _ = strconv.ParseInt(fields[1], 10, 64)
+				}
+			} else if strings.Index(s, "samples") != -1 {
+				// all other operations, like punch, setattr, sync, statfs, create or destroy
+				fields := strings.Fields(s)
+				if len(fields) > 2 && fields[2] == "samples" {
+					v, _ = strconv.ParseInt(fields[1], 10, 64)
+					stats.Ops[fields[0]] += v
+					if t, ok := parseTiming(fields); ok {
+						stats.Times[fields[0]] = t
+					}
+				}
 			}
 			line, isPrefix, err = r.ReadLine()
 		}
@@ -404,14 +592,17 @@ func readOstStatfile(filename string) OstStats {
 		f.Close()
 		// fmt.Printf("%s %v\n",filename, stats)
 	}
-	return stats
+	return stats, err
 }
 
-// read MDS performance values from file, return 64bit number of requests
-func readMdsStatfile(filename string) int64 {
-	var requests int64
+// read MDS performance values of a target from stats file name,
+// return 64bit number of requests and service times for each operation,
+// error if file could not be opened
+func readMdsStatfile(mdt, name string) (OpStats, OpTimes, error) {
+	requests := make(OpStats)
+	times := make(OpTimes)
 	var v int64
-	f, err := os.Open(filename)
+	f, err := source.open(mdtDevice, mdt, name)
 	if err == nil {
 		r := bufio.NewReader(f)
 
@@ -420,10 +611,16 @@ func readMdsStatfile(filename string) int64 {
 			s := string(line)
 
 			if strings.Index(s, "samples") != -1 {
+				// format is: name count samples [unit] and optional min max sum sumsq,
+				// so count is behind the name
 				fields := strings.Fields(s)
-				nr := len(fields)
-				v, _ = strconv.ParseInt(fields[nr-3], 10, 64)
-				requests += v
+				if len(fields) > 2 && fields[2] == "samples" {
+					v, _ = strconv.ParseInt(fields[1], 10, 64)
+					requests[fields[0]] += v
+					if t, ok := parseTiming(fields); ok {
+						times[fields[0]] = t
+					}
+				}
 			}
 			line, isPrefix, err = r.ReadLine()
 		}
@@ -431,65 +628,33 @@ func readMdsStatfile(filename string) int64 {
 		f.Close()
 		// fmt.Printf("%s %v\n",filename, requests)
 	}
-	return requests
-}
-
-// get list of OSTs and NIDs, nids is a map used as set
-func getOstAndNidlist() ([]string, map[string]struct{}) {
-	ostList := []string{}
-	tmpfile, _ := os.Open(ostprocpath)
-	files, _ := tmpfile.Readdir(-1)
-	tmpfile.Close()
-	for _, f := range files {
-		if f.IsDir() {
-			ostList = append(ostList, f.Name())
-		}
-	}
-
-	// we use a map as set emulator, using an empty struct as value
-	nidSet := make(map[string]struct{})
+	return requests, times, err
+}
 
-	for _, ost := range ostList {
-		tmpfile, _ := os.Open(ostprocpath + ost + "/exports")
-		files, _ := tmpfile.Readdirnames(-1)
-		tmpfile.Close()
-		for _, f := range files {
-			if strings.ContainsAny(f, "@") {
-				nidSet[f] = struct{}{}
-			}
-		}
-	}
+// get list of OSTs
+func getOstlist() []string {
+	return source.targets("obdfilter")
+}
 
-	return ostList, nidSet
+// get list of OSTs and the NIDs having exports on each OST
+func getOstAndNidlist() ([]string, map[string][]string) {
+	ostList := getOstlist()
+	return ostList, ostExports.lookup("obdfilter", ostList)
 }
 
-// get list of MDTs and NIDs, nids is a map used as set
-func getMdtAndNidlist() ([]string, map[string]struct{}) {
+// get list of MDTs
+func getMdtlist() []string {
 	mdtList := []string{}
-	for _, mdt := range mdtprocpath {
-		tmpfile, _ := os.Open(mdt)
-		files, _ := tmpfile.Readdir(-1)
-		tmpfile.Close()
-		for _, f := range files {
-			if f.IsDir() && strings.Index(f.Name(), "-MDT") != -1 {
-				mdtList = append(mdtList, f.Name())
-			}
-		}
-	}
-
-	// we use a map as set emulator, using an empty struct as value
-	nidSet := make(map[string]struct{})
-
-	for _, mdt := range mdtList {
-		tmpfile, _ := os.Open(realmdtprocpath + "/" + mdt + "/exports")
-		files, _ := tmpfile.Readdirnames(-1)
-		tmpfile.Close()
-		for _, f := range files {
-			if strings.ContainsAny(f, "@") {
-				nidSet[f] = struct{}{}
-			}
+	for _, mdt := range source.targets(mdtDevice) {
+		if strings.Index(mdt, "-MDT") != -1 {
+			mdtList = append(mdtList, mdt)
 		}
 	}
+	return mdtList
+}
 
-	return mdtList, nidSet
+// get list of MDTs and the NIDs having exports on each MDT
+func getMdtAndNidlist() ([]string, map[string][]string) {
+	mdtList := getMdtlist()
+	return mdtList, mdtExports.lookup(mdtDevice, mdtList)
 }
@@ -0,0 +1,190 @@
+package lustreserver
+
+// selection of nids, to skip e.g. routers, service nodes and
+// monitoring hosts nobody is interested in, and truncation of
+// differences to the busiest nids, to keep RPC payloads and inserts
+// bounded on big clusters
+
+import (
+	"regexp"
+	"sort"
+)
+
+// OtherNid is the name of the nid summing up all nids not in the top N
+const OtherNid = "other"
+
+// number of nids kept per target in differences, 0 to keep all, set with SetTopNids
+var topNids int
+
+// regular expressions for nids to collect and to skip, set with SetNidFilter
+var (
+	nidInclude []*regexp.Regexp
+	nidExclude []*regexp.Regexp
+)
+
+// SetNidFilter sets regular expressions for nids, if include is not empty,
+// only nids matching one of them are collected, nids matching one of exclude
+// are skipped, has to be called before the RPC servers are made
+func SetNidFilter(include, exclude []string) error {
+	nidInclude = nil
+	nidExclude = nil
+	for _, pattern := range include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		nidInclude = append(nidInclude, re)
+	}
+	for _, pattern := range exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		nidExclude = append(nidExclude, re)
+	}
+	return nil
+}
+
+// check if nid passes the filters
+func nidSelected(nid string) bool {
+	if len(nidInclude) > 0 {
+		found := false
+		for _, re := range nidInclude {
+			if re.MatchString(nid) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, re := range nidExclude {
+		if re.MatchString(nid) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetTopNids limits differences to the n busiest nids per target, all other nids are
+// summed up as OtherNid, 0 keeps all nids, totals of targets are not affected
+func SetTopNids(n int) {
+	topNids = n
+}
+
+// add b to a
+func (a OstStats) add(b OstStats) OstStats {
+	var result OstStats
+	result.WRqs = a.WRqs + b.WRqs
+	result.RRqs = a.RRqs + b.RRqs
+	result.WBs = a.WBs + b.WBs
+	result.RBs = a.RBs + b.RBs
+	result.Ops = a.Ops.add(b.Ops)
+	result.Times = a.Times.add(b.Times)
+	return result
+}
+
+// add b to a
+func (a OpStats) add(b OpStats) OpStats {
+	result := make(OpStats)
+	for op, v := range a {
+		result[op] = v
+	}
+	for op, v := range b {
+		result[op] += v
+	}
+	return result
+}
+
+// add b to a, maximum is the larger one
+func (a OpTimes) add(b OpTimes) OpTimes {
+	result := make(OpTimes)
+	for op, v := range a {
+		result[op] = v
+	}
+	for op, v := range b {
+		t := result[op]
+		t.Samples += v.Samples
+		t.Sum += v.Sum
+		t.Sumsq += v.Sumsq
+		if v.Max > t.Max {
+			t.Max = v.Max
+		}
+		result[op] = t
+	}
+	return result
+}
+
+// sort nids busiest first, and return the ones beyond topNids
+func otherNids(nids []string, busier func(a, b string) bool) []string {
+	if topNids <= 0 || len(nids) <= topNids {
+		return nil
+	}
+	sort.Slice(nids, func(i, j int) bool {
+		if busier(nids[i], nids[j]) {
+			return true
+		}
+		if busier(nids[j], nids[i]) {
+			return false
+		}
+		return nids[i] < nids[j]
+	})
+	return nids[topNids:]
+}
+
+// keep the topNids busiest nids of each OST, by bytes and then by requests,
+// and sum up the others as OtherNid
+func truncateOstNids(values *OstValues) {
+	for _, nidValues := range values.NidValues {
+		nids := make([]string, 0, len(nidValues))
+		for nid := range nidValues {
+			nids = append(nids, nid)
+		}
+		// bytes first, requests decide between nids without bulk IO
+		others := otherNids(nids, func(a, b string) bool {
+			va, vb := nidValues[a], nidValues[b]
+			if va.RBs+va.WBs != vb.RBs+vb.WBs {
+				return va.RBs+va.WBs > vb.RBs+vb.WBs
+			}
+			return va.RRqs+va.WRqs+va.Ops.Total() > vb.RRqs+vb.WRqs+vb.Ops.Total()
+		})
+		if len(others) == 0 {
+			continue
+		}
+		var other OstStats
+		for _, nid := range others {
+			other = other.add(nidValues[nid])
+			delete(nidValues, nid)
+		}
+		nidValues[OtherNid] = other
+	}
+}
+
+// keep the topNids busiest nids of each MDT, by requests, and sum up the others as OtherNid
+func truncateMdsNids(values *MdsValues) {
+	for mdt, nidValues := range values.NidValues {
+		nids := make([]string, 0, len(nidValues))
+		for nid := range nidValues {
+			nids = append(nids, nid)
+		}
+		others := otherNids(nids, func(a, b string) bool {
+			return nidValues[a].Total() > nidValues[b].Total()
+		})
+		if len(others) == 0 {
+			continue
+		}
+		other := make(OpStats)
+		otherTimes := make(OpTimes)
+		for _, nid := range others {
+			other = other.add(nidValues[nid])
+			otherTimes = otherTimes.add(values.NidTimes[mdt][nid])
+			delete(nidValues, nid)
+			delete(values.NidTimes[mdt], nid)
+		}
+		nidValues[OtherNid] = other
+		if len(otherTimes) > 0 {
+			values.NidTimes[mdt][OtherNid] = otherTimes
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package lustreserver
+
+// access to lustre parameters, independent of the lustre version
+//
+// lustre 1.8 and 2.x before 2.10 keep everything in /proc/fs/lustre,
+// 2.10 and later moved parts to /sys/fs/lustre (like version and target
+// directories) and /sys/kernel/debug/lustre (like brw_stats), and parts
+// stayed in /proc/fs/lustre (like stats and exports).
+// fileSource searches all these roots, lctlSource uses lctl get_param,
+// which knows where its version keeps a parameter, simSource serves a
+// simulated server from lustresim.
+// All readers go through source, never to the files directly.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/holgerBerger/go_ludalo/lustresim"
+)
+
+// paramSource gives access to parameters of lustre devices like obdfilter or mdt
+type paramSource interface {
+	// lustre version like "2.15.3"
+	version() (string, error)
+	// check if a device like "ost" or "mds" exists
+	hasDevice(device string) bool
+	// names of targets of a device, like fs-OST0000 for obdfilter
+	targets(device string) []string
+	// nids having exports of a target
+	exports(device, target string) []string
+	// modification time of exports of a target, false if not known
+	exportsMtime(device, target string) (time.Time, bool)
+	// open parameter file of a target, name is like stats or exports/<nid>/stats
+	open(device, target, name string) (io.ReadCloser, error)
+}
+
+// Sysdir is the path to lustre sysfs, change it with SetSysdir, empty to not use it
+var Sysdir = "/sys/fs/lustre/"
+
+// Debugdir is the path to lustre debugfs, change it with SetDebugdir, empty to not use it
+var Debugdir = "/sys/kernel/debug/lustre/"
+
+// source for all parameters, set by SetSource
+var source paramSource = &fileSource{[]string{Procdir, Sysdir, Debugdir}}
+
+// LustreVersion is the version of the running lustre, detected by SetSource
+var LustreVersion string
+
+// different lustre versions have different locations for MDT performance files,
+// set by SetSource
+var (
+	mdtDevice   = "mdt"
+	mdtStatname = "md_stats"
+)
+
+// SetSysdir changes the root of lustre sysfs, has to be called before SetSource
+func SetSysdir(dir string) {
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir = dir + "/"
+	}
+	Sysdir = dir
+}
+
+// SetDebugdir changes the root of lustre debugfs, has to be called before SetSource
+func SetDebugdir(dir string) {
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir = dir + "/"
+	}
+	Debugdir = dir
+}
+
+// SetSource selects where lustre parameters are read from and detects the lustre version,
+// kind is "files" to read Procdir, Sysdir and Debugdir, "lctl" to use lctl get_param,
+// or "auto" to use files if a version file is found there, and lctl otherwise,
+// has to be called before the RPC servers are made
+func SetSource(kind string) error {
+	files := new(fileSource)
+	for _, root := range []string{Procdir, Sysdir, Debugdir} {
+		if root != "" {
+			files.roots = append(files.roots, root)
+		}
+	}
+
+	switch kind {
+	case "files":
+		source = files
+	case "lctl":
+		lctl, err := exec.LookPath("lctl")
+		if err != nil {
+			return err
+		}
+		source = &lctlSource{lctl}
+	case "auto", "":
+		source = files
+		if _, err := files.version(); err != nil {
+			if lctl, err := exec.LookPath("lctl"); err == nil {
+				source = &lctlSource{lctl}
+			}
+		}
+	default:
+		return errors.New("unknown source " + kind + ", use files, lctl or auto")
+	}
+	detectVersion()
+	return nil
+}
+
+// SetSimulator serves counters of a simulated server instead of lustre,
+// has to be called before the RPC servers are made
+func SetSimulator(sim *lustresim.Sim) {
+	source = &simSource{sim}
+	detectVersion()
+}
+
+// detect lustre version of source and set version dependent locations
+func detectVersion() {
+	var err error
+	LustreVersion, err = source.version()
+	if err != nil {
+		// without version we assume a current version, better than giving up
+		log.Println("could not detect lustre version:", err)
+		LustreVersion = ""
+	} else {
+		log.Println("lustre version", LustreVersion)
+	}
+	if strings.HasPrefix(LustreVersion, "1.") {
+		mdtDevice = "mds"
+		mdtStatname = "stats"
+	} else {
+		mdtDevice = "mdt"
+		mdtStatname = "md_stats"
+	}
+}
+
+// HasOST checks if this server has OSTs
+func HasOST() bool {
+	return source.hasDevice("ost")
+}
+
+// HasMDT checks if this server has MDTs
+func HasMDT() bool {
+	return source.hasDevice("mds")
+}
+
+// parse version from version file or lctl output, formats are
+// "lustre: 2.5.3" (old) and "2.15.3" (new)
+func parseVersion(data []byte) (string, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	line, _, err := r.ReadLine()
+	if err != nil {
+		return "", errors.New("empty lustre version")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return "", errors.New("empty lustre version")
+	}
+	return fields[len(fields)-1], nil
+}
+
+// fileSource reads parameters from files below several roots,
+// the first root having a file wins
+type fileSource struct {
+	roots []string
+}
+
+func (s *fileSource) version() (string, error) {
+	for _, root := range s.roots {
+		data, err := ioutil.ReadFile(root + "version")
+		if err == nil {
+			return parseVersion(data)
+		}
+	}
+	return "", errors.New("no lustre version file found")
+}
+
+func (s *fileSource) hasDevice(device string) bool {
+	for _, root := range s.roots {
+		if _, err := os.Stat(root + device); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fileSource) targets(device string) []string {
+	// targets can show up in several roots, we use a map as set emulator
+	targetSet := make(map[string]struct{})
+	for _, root := range s.roots {
+		tmpfile, err := os.Open(root + device)
+		if err != nil {
+			continue
+		}
+		files, _ := tmpfile.Readdir(-1)
+		tmpfile.Close()
+		for _, f := range files {
+			if f.IsDir() {
+				targetSet[f.Name()] = struct{}{}
+			}
+		}
+	}
+	targetList := []string{}
+	for t := range targetSet {
+		targetList = append(targetList, t)
+	}
+	sort.Strings(targetList)
+	return targetList
+}
+
+func (s *fileSource) exports(device, target string) []string {
+	nidList := []string{}
+	for _, root := range s.roots {
+		tmpfile, err := os.Open(root + device + "/" + target + "/exports")
+		if err != nil {
+			continue
+		}
+		files, _ := tmpfile.Readdirnames(-1)
+		tmpfile.Close()
+		for _, f := range files {
+			if strings.ContainsAny(f, "@") {
+				nidList = append(nidList, f)
+			}
+		}
+		break
+	}
+	return nidList
+}
+
+func (s *fileSource) exportsMtime(device, target string) (time.Time, bool) {
+	for _, root := range s.roots {
+		info, err := os.Stat(root + device + "/" + target + "/exports")
+		if err == nil {
+			return info.ModTime(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (s *fileSource) open(device, target, name string) (io.ReadCloser, error) {
+	var err error
+	var f *os.File
+	for _, root := range s.roots {
+		f, err = os.Open(root + device + "/" + target + "/" + name)
+		if err == nil {
+			return f, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no roots to read from")
+	}
+	return nil, err
+}
+
+// lctlSource reads parameters with lctl, slower than files, as each
+// parameter needs a process, but works for all lustre versions
+type lctlSource struct {
+	lctl string
+}
+
+func (s *lctlSource) getParam(param string) ([]byte, error) {
+	return exec.Command(s.lctl, "get_param", "-n", param).Output()
+}
+
+// list parameters, returns names with prefix removed
+func (s *lctlSource) listParam(prefix string) []string {
+	out, err := exec.Command(s.lctl, "list_param", prefix+"*").Output()
+	if err != nil {
+		return []string{}
+	}
+	names := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// list_param marks directories with a trailing / with -F, which we do not use,
+		// but older versions print it anyhow
+		line = strings.TrimSuffix(line, "/")
+		if strings.HasPrefix(line, prefix) {
+			names = append(names, strings.TrimPrefix(line, prefix))
+		}
+	}
+	return names
+}
+
+func (s *lctlSource) version() (string, error) {
+	out, err := s.getParam("version")
+	if err != nil {
+		return "", err
+	}
+	return parseVersion(out)
+}
+
+func (s *lctlSource) hasDevice(device string) bool {
+	return len(s.listParam(device+".")) > 0
+}
+
+func (s *lctlSource) targets(device string) []string {
+	targetList := s.listParam(device + ".")
+	sort.Strings(targetList)
+	return targetList
+}
+
+func (s *lctlSource) exports(device, target string) []string {
+	nidList := []string{}
+	for _, nid := range s.listParam(device + "." + target + ".exports.") {
+		if strings.ContainsAny(nid, "@") {
+			nidList = append(nidList, nid)
+		}
+	}
+	return nidList
+}
+
+// lctl does not give modification times, exports are refreshed by time only
+func (s *lctlSource) exportsMtime(device, target string) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (s *lctlSource) open(device, target, name string) (io.ReadCloser, error) {
+	out, err := s.getParam(device + "." + target + "." + strings.Replace(name, "/", ".", -1))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(out)), nil
+}
+
+// simSource reads parameters from a simulation, the simulation advances
+// when targets are listed, which is done once for each reading of values,
+// so all files of one reading show the same moment
+type simSource struct {
+	sim *lustresim.Sim
+}
+
+func (s *simSource) version() (string, error) {
+	return s.sim.Version(), nil
+}
+
+func (s *simSource) hasDevice(device string) bool {
+	return s.sim.HasDevice(device)
+}
+
+func (s *simSource) targets(device string) []string {
+	s.sim.Update()
+	return s.sim.Targets(device)
+}
+
+func (s *simSource) exports(device, target string) []string {
+	return s.sim.Exports(device, target)
+}
+
+// exports of the simulation change only by failover, which is seen in targets
+func (s *simSource) exportsMtime(device, target string) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (s *simSource) open(device, target, name string) (io.ReadCloser, error) {
+	data, err := s.sim.File(device, target, name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
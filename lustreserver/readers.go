@@ -0,0 +1,116 @@
+package lustreserver
+
+// parallel reading of stats files, with thousands of exports reading one
+// file after the other takes seconds, so files are read by a bounded number
+// of goroutines, and reading stops at a deadline, to deliver partial results
+// in time instead of blocking the cycle of the aggregator. the bound is for
+// all calls, a read hanging on a file keeps its slot until it returns, so
+// hanging files can not start more and more goroutines cycle after cycle
+
+import (
+	"time"
+)
+
+// slots for goroutines reading stats files, and maximum time for reading
+// all files of a call (0 for no limit), change them with SetReaders
+var (
+	slots       = make(chan struct{}, 8)
+	readTimeout time.Duration
+)
+
+// SetReaders changes the number of goroutines reading stats files and the time after
+// which reading stops and results are returned marked as incomplete, 0 for no limit
+func SetReaders(n int, timeout time.Duration) {
+	if n < 1 {
+		n = 1
+	}
+	slots = make(chan struct{}, n)
+	readTimeout = timeout
+}
+
+// result of job i of readParallel
+type readResult struct {
+	i int
+	v interface{}
+}
+
+// call work for 0..n-1, each in a goroutine holding one of the slots, and return
+// the results in order, results not read before readTimeout are nil and false is
+// returned, jobs not started by then are skipped
+func readParallel(n int, work func(i int) interface{}) ([]interface{}, bool) {
+	results := make([]interface{}, n)
+	// buffered, so reads returning after the deadline never block
+	out := make(chan readResult, n)
+	sem := slots
+
+	var timeout <-chan time.Time
+	if readTimeout > 0 {
+		timer := time.NewTimer(readTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	started := 0
+	for received := 0; received < n; {
+		// nil channel when all are started, never ready
+		var acquire chan struct{}
+		if started < n {
+			acquire = sem
+		}
+		select {
+		case acquire <- struct{}{}:
+			go func(i int) {
+				out <- readResult{i, work(i)}
+				<-sem
+			}(started)
+			started++
+		case r := <-out:
+			results[r.i] = r.v
+			received++
+		case <-timeout:
+			return results, false
+		}
+	}
+	return results, true
+}
+
+// take values of old for targets and nids missing in incomplete current values,
+// or not read because of errors, so they are part of the next difference instead
+// of being counted as new
+func keepOstValues(old, current OstValues) OstValues {
+	for ost, total := range old.OstTotal {
+		if _, ok := current.OstTotal[ost]; !ok {
+			current.OstTotal[ost] = total
+		}
+		if current.NidValues[ost] == nil {
+			current.NidValues[ost] = make(map[string]OstStats)
+		}
+		for nid, stats := range old.NidValues[ost] {
+			if _, ok := current.NidValues[ost][nid]; !ok {
+				current.NidValues[ost][nid] = stats
+			}
+		}
+	}
+	return current
+}
+
+// take values of old for targets and nids missing in incomplete current values,
+// like keepOstValues
+func keepMdsValues(old, current MdsValues) MdsValues {
+	for mdt, total := range old.MdsTotal {
+		if _, ok := current.MdsTotal[mdt]; !ok {
+			current.MdsTotal[mdt] = total
+			current.TotalTimes[mdt] = old.TotalTimes[mdt]
+		}
+		if current.NidValues[mdt] == nil {
+			current.NidValues[mdt] = make(map[string]OpStats)
+			current.NidTimes[mdt] = make(map[string]OpTimes)
+		}
+		for nid, ops := range old.NidValues[mdt] {
+			if _, ok := current.NidValues[mdt][nid]; !ok {
+				current.NidValues[mdt][nid] = ops
+				current.NidTimes[mdt][nid] = old.NidTimes[mdt][nid]
+			}
+		}
+	}
+	return current
+}
@@ -0,0 +1,136 @@
+package lustreserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// OST stats file as written by lustre 2.x
+const benchStats = `snapshot_time             1409223405.372386 secs.usecs
+read_bytes                21 samples [bytes] 4096 1048576 17473536
+write_bytes               4 samples [bytes] 4096 1048576 3153920
+setattr                   2 samples [reqs]
+punch                     1 samples [reqs]
+sync                      3 samples [reqs]
+`
+
+// build a proc tree with osts OSTs, each having nids exports
+func makeBenchTree(b testing.TB, osts, nids int) string {
+	dir, err := ioutil.TempDir("", "ludalo-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	write := func(name string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(benchStats), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "version"), []byte("lustre: 2.5.3\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "ost"), 0755)
+	for o := 0; o < osts; o++ {
+		ost := filepath.Join(dir, "obdfilter", fmt.Sprintf("bench-OST%04x", o))
+		write(filepath.Join(ost, "stats"))
+		for n := 0; n < nids; n++ {
+			write(filepath.Join(ost, "exports", fmt.Sprintf("10.0.%d.%d@o2ib", n/256, n%256), "stats"))
+		}
+	}
+	return dir
+}
+
+// read a tree of 10 OSTs with 1000 exports each, with different numbers of readers
+func BenchmarkReadOstValues(b *testing.B) {
+	dir := makeBenchTree(b, 10, 1000)
+	defer os.RemoveAll(dir)
+	SetProcdir(dir)
+	SetSysdir("")
+	SetDebugdir("")
+	if err := SetSource("files"); err != nil {
+		b.Fatal(err)
+	}
+	defer SetReaders(8, 0)
+
+	for _, n := range []int{1, 4, 8, 16} {
+		b.Run(fmt.Sprintf("readers=%d", n), func(b *testing.B) {
+			SetReaders(n, 0)
+			ostlist, nids := getOstAndNidlist()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				values := readOstValues(ostlist, nids)
+				if len(values.NidValues[ostlist[0]]) != 1000 {
+					b.Fatal("missing exports")
+				}
+			}
+		})
+	}
+}
+
+// source where opening files of target blocks until block is closed, like a hanging server
+type blockingSource struct {
+	paramSource
+	target string
+	block  chan struct{}
+}
+
+func (s *blockingSource) open(device, target, name string) (io.ReadCloser, error) {
+	if target == s.target {
+		<-s.block
+	}
+	return s.paramSource.open(device, target, name)
+}
+
+// reading stops at the deadline, with the values read so far, marked as incomplete
+func TestReadTimeout(t *testing.T) {
+	dir := makeBenchTree(t, 3, 20)
+	defer os.RemoveAll(dir)
+	SetProcdir(dir)
+	SetSysdir("")
+	SetDebugdir("")
+	if err := SetSource("files"); err != nil {
+		t.Fatal(err)
+	}
+	blocking := &blockingSource{source, "bench-OST0001", make(chan struct{})}
+	source = blocking
+	SetReaders(2, 200*time.Millisecond)
+	defer SetReaders(8, 0)
+	defer func() {
+		// unblock the reads and wait until they gave back their slots
+		close(blocking.block)
+		for i := 0; i < cap(slots); i++ {
+			slots <- struct{}{}
+		}
+	}()
+
+	start := time.Now()
+	values := readOstValues(getOstAndNidlist())
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("reading took %v", d)
+	}
+	if !values.Incomplete {
+		t.Errorf("values not marked as incomplete")
+	}
+	if _, ok := values.OstTotal["bench-OST0000"]; !ok || len(values.NidValues["bench-OST0000"]) != 20 {
+		t.Errorf("values read before deadline missing: %v, %d nids", values.OstTotal, len(values.NidValues["bench-OST0000"]))
+	}
+	if _, ok := values.OstTotal["bench-OST0001"]; ok {
+		t.Errorf("values of blocked OST %v", values.OstTotal["bench-OST0001"])
+	}
+
+	// hanging reads keep their slots, the next call does not start more goroutines
+	goroutines := runtime.NumGoroutine()
+	values = readOstValues(getOstAndNidlist())
+	if !values.Incomplete || len(values.OstTotal) != 0 {
+		t.Errorf("values read with all slots blocked %v", values.OstTotal)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines after second call, %d before", n, goroutines)
+	}
+}
@@ -0,0 +1,204 @@
+package lustreserver
+
+// buffered mode, the collector samples differences on its own ticker and
+// keeps them in a ring buffer, consumers pull all samples newer than the
+// last one they got, so short stalls or reconnects of a consumer lose nothing
+// and samples carry the time they were taken, not the time they were pulled
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// OssSample is one sample of the sampler, as difference to the sample before
+type OssSample struct {
+	Seq    int64 // sequence number, increasing by one for each sample
+	Values OstValues
+	Jobs   OstJobValues
+	Brw    BrwValues
+}
+
+// MdsSample is one sample of the sampler, as difference to the sample before
+type MdsSample struct {
+	Seq    int64 // sequence number, increasing by one for each sample
+	Values MdsValues
+	Jobs   MdsJobValues
+}
+
+// OssSamples is the reply of GetSamples for OST
+type OssSamples struct {
+	Epoch   int64 // start time of sampler, changes if collector was restarted
+	First   int64 // sequence number of oldest sample in buffer
+	Samples []OssSample
+}
+
+// MdsSamples is the reply of GetSamples for MDS
+type MdsSamples struct {
+	Epoch   int64 // start time of sampler, changes if collector was restarted
+	First   int64 // sequence number of oldest sample in buffer
+	Samples []MdsSample
+}
+
+// one entry of a sampleRing
+type ringEntry struct {
+	seq int64
+	v   interface{}
+}
+
+// sampleRing keeps the newest samples, older ones are overwritten
+type sampleRing struct {
+	sync.Mutex
+	entries []ringEntry
+	next    int   // position of next entry once ring is full
+	last    int64 // sequence number of newest entry
+}
+
+// rings and start time of sampler, set by StartSampler
+var (
+	samplerEpoch int64
+	ossRing      *sampleRing
+	mdsRing      *sampleRing
+)
+
+func newSampleRing(size int) *sampleRing {
+	return &sampleRing{entries: make([]ringEntry, 0, size)}
+}
+
+// add a sample, overwriting the oldest one if ring is full
+func (r *sampleRing) push(v interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.last++
+	e := ringEntry{r.last, v}
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+	} else {
+		r.entries[r.next] = e
+	}
+	r.next = (r.next + 1) % cap(r.entries)
+}
+
+// return sequence number of oldest sample and all samples newer than seq, oldest first
+func (r *sampleRing) since(seq int64) (int64, []ringEntry) {
+	r.Lock()
+	defer r.Unlock()
+	n := len(r.entries)
+	start := 0
+	if n == cap(r.entries) {
+		start = r.next
+	}
+	result := []ringEntry{}
+	for i := 0; i < n; i++ {
+		e := r.entries[(start+i)%n]
+		if e.seq > seq {
+			result = append(result, e)
+		}
+	}
+	return r.last - int64(n) + 1, result
+}
+
+// StartSampler starts sampling every interval, keeping the newest size samples,
+// has to be called after the RPC servers are made
+func StartSampler(interval time.Duration, size int) {
+	if size < 1 {
+		size = 1
+	}
+	samplerEpoch = time.Now().Unix()
+	ossRing = newSampleRing(size)
+	mdsRing = newSampleRing(size)
+	go ossSampler(interval)
+	go mdsSampler(interval)
+}
+
+// sample OSTs, using an own diff session
+func ossSampler(interval time.Duration) {
+	oss := new(OssRpcT)
+	var session int64
+	oss.InitDiff(0, &session)
+
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if !HasOST() {
+			continue
+		}
+		var s OssSample
+		err := oss.GetValuesDiff(session, &s.Values)
+		if err == nil {
+			err = oss.GetJobStatsDiff(session, &s.Jobs)
+		}
+		if err == nil {
+			err = oss.GetBrwStatsDiff(session, &s.Brw)
+		}
+		if err != nil {
+			// session expired, can only happen with very long intervals
+			log.Print("sampler: ", err)
+			oss.InitDiff(0, &session)
+			continue
+		}
+		ossRing.push(s)
+	}
+}
+
+// sample MDTs, using an own diff session
+func mdsSampler(interval time.Duration) {
+	mds := new(MdsRpcT)
+	var session int64
+	mds.InitDiff(0, &session)
+
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if !HasMDT() {
+			continue
+		}
+		var s MdsSample
+		err := mds.GetValuesDiff(session, &s.Values)
+		if err == nil {
+			err = mds.GetJobStatsDiff(session, &s.Jobs)
+		}
+		if err != nil {
+			// session expired, can only happen with very long intervals
+			log.Print("sampler: ", err)
+			mds.InitDiff(0, &session)
+			continue
+		}
+		mdsRing.push(s)
+	}
+}
+
+// GetSamples RPC call for OST, return all samples of the sampler with a sequence number
+// larger than since, samples stay in the buffer, so any number of consumers can pull them
+func (*OssRpcT) GetSamples(since int64, result *OssSamples) error {
+	if ossRing == nil {
+		return errors.New("sampler not running")
+	}
+	result.Epoch = samplerEpoch
+	first, entries := ossRing.since(since)
+	result.First = first
+	result.Samples = make([]OssSample, 0, len(entries))
+	for _, e := range entries {
+		s := e.v.(OssSample)
+		s.Seq = e.seq
+		result.Samples = append(result.Samples, s)
+	}
+	return nil
+}
+
+// GetSamples RPC call for MDS, return all samples of the sampler with a sequence number
+// larger than since, samples stay in the buffer, so any number of consumers can pull them
+func (*MdsRpcT) GetSamples(since int64, result *MdsSamples) error {
+	if mdsRing == nil {
+		return errors.New("sampler not running")
+	}
+	result.Epoch = samplerEpoch
+	first, entries := mdsRing.since(since)
+	result.First = first
+	result.Samples = make([]MdsSample, 0, len(entries))
+	for _, e := range entries {
+		s := e.v.(MdsSample)
+		s.Seq = e.seq
+		result.Samples = append(result.Samples, s)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package lustreserver
+
+// diff sessions, each consumer of differences (aggregator, debugging tools)
+// gets its own session with its own previous snapshot, so several consumers
+// can poll the same collector without disturbing each others differences
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// sessions not used for this time are removed when new sessions are created
+const sessionTimeout = 30 * time.Minute
+
+// ossSession holds previous OST snapshots of one consumer
+type ossSession struct {
+	sync.Mutex
+	values  OstValues
+	jobs    OstJobValues
+	brw     BrwValues
+	lastuse time.Time
+}
+
+// mdsSession holds previous MDT snapshots of one consumer
+type mdsSession struct {
+	sync.Mutex
+	values  MdsValues
+	jobs    MdsJobValues
+	lastuse time.Time
+}
+
+// all open sessions, protected by sessionLock
+var (
+	sessionLock sync.Mutex
+	lastSession int64
+	ossSessions = make(map[int64]*ossSession)
+	mdsSessions = make(map[int64]*mdsSession)
+)
+
+// InitDiff RPC call for OST, creates a new session with a first snapshot,
+// the session has to be passed to all following calls for differences,
+// targets missing in the first snapshot get no difference before they were read once
+func (*OssRpcT) InitDiff(arg int, session *int64) error {
+	s := new(ossSession)
+	s.lastuse = time.Now()
+	if HasOST() {
+		s.values = readOstValues(getOstAndNidlist())
+		s.jobs = readOstJobValues(getOstlist())
+		s.brw = readBrwValues(getOstlist())
+	}
+
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	expireSessions()
+	lastSession++
+	ossSessions[lastSession] = s
+	*session = lastSession
+	return nil
+}
+
+// InitDiff RPC call for MDS, creates a new session with a first snapshot,
+// the session has to be passed to all following calls for differences,
+// targets missing in the first snapshot get no difference before they were read once
+func (*MdsRpcT) InitDiff(arg int, session *int64) error {
+	s := new(mdsSession)
+	s.lastuse = time.Now()
+	if HasMDT() {
+		s.values = readMdsValues(getMdtAndNidlist())
+		s.jobs = readMdsJobValues(getMdtlist())
+	}
+
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	expireSessions()
+	lastSession++
+	mdsSessions[lastSession] = s
+	*session = lastSession
+	return nil
+}
+
+// get OST session, error if it does not exist (any more)
+func getOssSession(session int64) (*ossSession, error) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	s, ok := ossSessions[session]
+	if !ok {
+		return nil, errors.New("unknown ost session, call InitDiff first")
+	}
+	s.lastuse = time.Now()
+	return s, nil
+}
+
+// get MDT session, error if it does not exist (any more)
+func getMdsSession(session int64) (*mdsSession, error) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	s, ok := mdsSessions[session]
+	if !ok {
+		return nil, errors.New("unknown mdt session, call InitDiff first")
+	}
+	s.lastuse = time.Now()
+	return s, nil
+}
+
+// remove sessions not used for sessionTimeout, e.g. of consumers which
+// reconnected, sessionLock has to be held
+func expireSessions() {
+	now := time.Now()
+	for id, s := range ossSessions {
+		if now.Sub(s.lastuse) > sessionTimeout {
+			delete(ossSessions, id)
+		}
+	}
+	for id, s := range mdsSessions {
+		if now.Sub(s.lastuse) > sessionTimeout {
+			delete(mdsSessions, id)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package lustreserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/holgerBerger/go_ludalo/lustresim"
+)
+
+// counters of the simulation are read like files of a real server, totals of
+// targets have to match the sums of their nids and their jobs in all versions
+func TestSimulator(t *testing.T) {
+	versions := []struct {
+		version     string
+		times, jobs bool
+	}{
+		{"1.8.9", false, false},
+		{"2.5.3", false, true},
+		{"2.12.9", true, true},
+		{"2.15.3", true, true},
+	}
+	for _, v := range versions {
+		version := v.version
+		config := lustresim.DefaultConfig()
+		config.Version = version
+		config.FailoverRate = 0
+		sim, err := lustresim.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetSimulator(sim)
+		if !HasOST() || !HasMDT() {
+			t.Fatalf("%s: simulation has no OSTs or MDTs", version)
+		}
+
+		// start with checkpoint and metadata storm running
+		sim.Advance(150 * time.Second)
+		oldOst := readOstValues(getOstAndNidlist())
+		oldMds := readMdsValues(getMdtAndNidlist())
+		sim.Advance(60 * time.Second)
+		ost := diffOstValues(oldOst, readOstValues(getOstAndNidlist()))
+		mds := diffMdsValues(oldMds, readMdsValues(getMdtAndNidlist()))
+
+		if len(ost.OstTotal) != 10 || len(mds.MdsTotal) != 2 {
+			t.Fatalf("%s: got %d OSTs and %d MDTs, expected 10 and 2", version, len(ost.OstTotal), len(mds.MdsTotal))
+		}
+		for target, total := range ost.OstTotal {
+			var sum OstStats
+			for _, stats := range ost.NidValues[target] {
+				sum = sum.add(stats)
+			}
+			if sum.WBs != total.WBs || sum.WRqs != total.WRqs || sum.RBs != total.RBs || sum.Ops["sync"] != total.Ops["sync"] {
+				t.Errorf("%s: %s nids sum up to %v, total is %v", version, target, sum, total)
+			}
+		}
+		if ost.OstTotal["scratch-OST0000"].WBs == 0 || ost.OstTotal["home-OST0000"].Ops["sync"] == 0 {
+			t.Errorf("%s: expected writes and syncs, got %v", version, ost.OstTotal)
+		}
+		for target, total := range mds.MdsTotal {
+			sum := make(OpStats)
+			for _, ops := range mds.NidValues[target] {
+				sum = sum.add(ops)
+			}
+			if sum.Total() != total.Total() || sum["mknod"] != total["mknod"] {
+				t.Errorf("%s: %s nids sum up to %v, total is %v", version, target, sum, total)
+			}
+			if total["open"] == 0 {
+				t.Errorf("%s: %s has no opens", version, target)
+			}
+			if times := mds.TotalTimes[target]; (len(times) > 0) != v.times {
+				t.Errorf("%s: %s has service times %v", version, target, times)
+			}
+		}
+
+		if v.jobs {
+			jobs := readOstJobValues(getOstlist())
+			for target, stats := range readOstValues(getOstAndNidlist()).OstTotal {
+				var sum OstStats
+				for _, job := range jobs.JobValues[target] {
+					sum = sum.add(job)
+				}
+				if sum.WBs != stats.WBs || sum.RRqs != stats.RRqs {
+					t.Errorf("%s: %s jobs sum up to %v, total is %v", version, target, sum, stats)
+				}
+			}
+		}
+
+		for target, brw := range readBrwValues(getOstlist()).OstBrw {
+			var rpcs int64
+			for _, bucket := range brw["pages"] {
+				rpcs += bucket.Write
+			}
+			if rpcs == 0 {
+				t.Errorf("%s: %s has no write rpcs in brw_stats", version, target)
+			}
+		}
+
+		capacity := readCapacityValues(mdtDevice, getMdtlist())
+		if c := capacity.Targets["home-MDT0000"]; c.FilesTotal == 0 || c.FilesFree == 0 {
+			t.Errorf("%s: no inodes on MDT, got %v", version, c)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package lustreserver
+
+// TLS for RPC, servers require client certificates signed by a CA, so only
+// holders of such a certificate (like the aggregator or top) can talk to
+// collectors and the aggregator, and traffic is encrypted.
+// Clients verify the certificate of the server against the name they dial,
+// so certificates of collectors have to contain the names used in ludalo.config.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+)
+
+// TLSConfig gives PEM files for TLS, TLS is used if Cert is set
+type TLSConfig struct {
+	Cert string // certificate of this side
+	Key  string // private key of this side
+	CA   string // certificate of CA to verify the other side
+}
+
+// TLS config for StartServer, set by SetServerTLS, nil for plain RPC
+var serverTLS *tls.Config
+
+// Enabled checks if TLS is configured
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != ""
+}
+
+// load certificate, key and CA
+func (c TLSConfig) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return cert, nil, err
+	}
+	if c.CA == "" {
+		return cert, nil, errors.New("no CA to verify the other side")
+	}
+	pem, err := ioutil.ReadFile(c.CA)
+	if err != nil {
+		return cert, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return cert, nil, errors.New("no certificates found in " + c.CA)
+	}
+	return cert, pool, nil
+}
+
+// ServerTLS returns a TLS config for servers, requiring client certificates
+// signed by the CA, nil if TLS is not configured
+func ServerTLS(c TLSConfig) (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLS returns a TLS config for clients, verifying servers with the CA,
+// nil if TLS is not configured
+func ClientTLS(c TLSConfig) (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// SetServerTLS enables TLS for StartServer, has to be called before StartServer
+func SetServerTLS(c TLSConfig) error {
+	config, err := ServerTLS(c)
+	if err != nil {
+		return err
+	}
+	serverTLS = config
+	return nil
+}
+
+// Listen listens on address in form host:port, with TLS if config is not nil
+func Listen(address string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return net.Listen("tcp", address)
+	}
+	return tls.Listen("tcp", address, config)
+}
+
+// Dial connects to the RPC server at address in form host:port, with TLS if config is not nil
+func Dial(address string, config *tls.Config) (*rpc.Client, error) {
+	if config == nil {
+		return rpc.Dial("tcp", address)
+	}
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,171 @@
+package lustreserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// certificate and key, signed by parent or self signed if parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// create a certificate for name, a CA if parent is nil
+func makeTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// write certificate and key as PEM files into dir, return TLSConfig using them with CA ca
+func (c *testCert) write(t *testing.T, dir, name string, ca *testCert) TLSConfig {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := TLSConfig{
+		Cert: filepath.Join(dir, name+".crt"),
+		Key:  filepath.Join(dir, name+".key"),
+		CA:   filepath.Join(dir, name+"-ca.crt"),
+	}
+	files := map[string]*pem.Block{
+		config.Cert: {Type: "CERTIFICATE", Bytes: c.cert.Raw},
+		config.Key:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+		config.CA:   {Type: "CERTIFICATE", Bytes: ca.cert.Raw},
+	}
+	for file, block := range files {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return config
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ludalo-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := makeTestCert(t, "ludalo CA", nil)
+	otherCA := makeTestCert(t, "other CA", nil)
+	serverConfig := makeTestCert(t, "collector", ca).write(t, dir, "collector", ca)
+	clientConfig := makeTestCert(t, "aggregator", ca).write(t, dir, "aggregator", ca)
+	strangerConfig := makeTestCert(t, "stranger", otherCA).write(t, dir, "stranger", ca)
+
+	serverTLS, err := ServerTLS(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := rpc.NewServer()
+	server.Register(new(ServerRpcT))
+	go server.Accept(l)
+	address := l.Addr().String()
+
+	// client with certificate signed by CA
+	config, err := ClientTLS(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(address, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var isOST bool
+	if err := client.Call("ServerRpcT.IsOST", 0, &isOST); err != nil {
+		t.Error("call with valid client certificate failed:", err)
+	}
+	client.Close()
+
+	// client with certificate of another CA
+	config, err = ClientTLS(strangerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = Dial(address, config)
+	if err == nil {
+		err = client.Call("ServerRpcT.IsOST", 0, &isOST)
+		client.Close()
+	}
+	if err == nil {
+		t.Error("call with client certificate of other CA succeeded")
+	}
+
+	// client without certificate
+	config.Certificates = nil
+	client, err = Dial(address, config)
+	if err == nil {
+		err = client.Call("ServerRpcT.IsOST", 0, &isOST)
+		client.Close()
+	}
+	if err == nil {
+		t.Error("call without client certificate succeeded")
+	}
+
+	// plain client
+	client, err = Dial(address, nil)
+	if err == nil {
+		err = client.Call("ServerRpcT.IsOST", 0, &isOST)
+		client.Close()
+	}
+	if err == nil {
+		t.Error("call without TLS succeeded")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	if config, err := ServerTLS(TLSConfig{}); config != nil || err != nil {
+		t.Error("empty config should give plain RPC")
+	}
+	if _, err := ServerTLS(TLSConfig{Cert: "/nonexistent.crt", Key: "/nonexistent.key"}); err == nil {
+		t.Error("missing files should give an error")
+	}
+}
@@ -0,0 +1,312 @@
+package lustreserver
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/holgerBerger/go_ludalo/fakeproc"
+	"github.com/holgerBerger/go_ludalo/lustresim"
+)
+
+// write a tree of version and read it with the file source, remove it with Remove
+func useTree(t *testing.T, version string) *fakeproc.Tree {
+	config := lustresim.DefaultConfig()
+	config.Version = version
+	config.FailoverRate = 0
+	tree, err := fakeproc.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetProcdir(tree.Procdir)
+	SetSysdir(tree.Sysdir)
+	SetDebugdir(tree.Debugdir)
+	if err := SetSource("files"); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// all readers have to find their files in the layout and format of each version
+func TestVersions(t *testing.T) {
+	for _, version := range fakeproc.Versions {
+		tree := useTree(t, version)
+		// checkpoint, metadata storm and small IO are running
+		if err := tree.Advance(150 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		v2 := version[0] == '2'
+		timed := version == "2.12.9" || version == "2.15.3"
+
+		if LustreVersion != version {
+			t.Errorf("%s: detected version %s", version, LustreVersion)
+		}
+		if !HasOST() || !HasMDT() {
+			t.Errorf("%s: no OSTs or MDTs found", version)
+		}
+		if (mdtDevice == "mdt") != v2 {
+			t.Errorf("%s: MDT device is %s", version, mdtDevice)
+		}
+
+		osts, nids := getOstAndNidlist()
+		if len(osts) != 10 || osts[0] != "home-OST0000" || len(nids["scratch-OST0007"]) != 64 {
+			t.Errorf("%s: found OSTs %v with %d nids", version, osts, len(nids["scratch-OST0007"]))
+		}
+		mdts, mdtNids := getMdtAndNidlist()
+		if len(mdts) != 2 || len(mdtNids["scratch-MDT0000"]) != 64 {
+			t.Errorf("%s: found MDTs %v with %d nids", version, mdts, len(mdtNids["scratch-MDT0000"]))
+		}
+
+		total, err := readOstStatfile("scratch-OST0000", "stats")
+		if err != nil || total.WBs == 0 || total.WRqs == 0 {
+			t.Errorf("%s: OST stats %v, %v", version, total, err)
+		}
+		var sum OstStats
+		for _, nid := range nids["scratch-OST0000"] {
+			stats, err := readOstStatfile("scratch-OST0000", "exports/"+nid+"/stats")
+			if err != nil {
+				t.Fatalf("%s: %v", version, err)
+			}
+			sum = sum.add(stats)
+		}
+		if sum.WBs != total.WBs || sum.RBs != total.RBs || sum.Ops["statfs"] != total.Ops["statfs"] {
+			t.Errorf("%s: nids sum up to %v, total is %v", version, sum, total)
+		}
+		if (len(total.Times) > 0) != timed {
+			t.Errorf("%s: OST service times %v", version, total.Times)
+		}
+		small, _ := readOstStatfile("home-OST0000", "stats")
+		if small.Ops["sync"] == 0 || small.WBs != small.WRqs*4096 {
+			t.Errorf("%s: small IO stats %v", version, small)
+		}
+
+		ops, times, err := readMdsStatfile("scratch-MDT0000", mdtStatname)
+		if err != nil || ops["open"] == 0 || ops["mknod"] == 0 {
+			t.Errorf("%s: MDT stats %v, %v", version, ops, err)
+		}
+		if (len(times) > 0) != timed || (timed && times["open"].Avg() == 0) {
+			t.Errorf("%s: MDT service times %v", version, times)
+		}
+
+		if brw := readBrwStatsfile("scratch-OST0000"); brw["pages"]["256"].Write == 0 || brw["disk_iosize"]["1M"].Write == 0 {
+			t.Errorf("%s: brw_stats %v", version, brw)
+		}
+
+		jobs := readOstJobValues(osts)
+		if _, ok := jobs.JobValues["scratch-OST0000"]["checkpoint.1002"]; ok != (version != "1.8.9") {
+			t.Errorf("%s: job_stats %v", version, jobs.JobValues["scratch-OST0000"])
+		}
+
+		capacity := readCapacityValues("obdfilter", osts)
+		if c := capacity.Targets["scratch-OST0000"]; c.KBytesTotal != 16<<30 || c.KBytesFree == 0 || c.KBytesFree >= c.KBytesTotal {
+			t.Errorf("%s: OST capacity %v", version, c)
+		}
+		capacity = readCapacityValues(mdtDevice, mdts)
+		if c := capacity.Targets["scratch-MDT0000"]; c.FilesTotal != 1<<30 || c.FilesFree == 0 {
+			t.Errorf("%s: MDT capacity %v", version, c)
+		}
+
+		tree.Remove()
+	}
+}
+
+// exports are cached, but changes of exports and targets have to be seen
+func TestDiscovery(t *testing.T) {
+	tree := useTree(t, "2.15.3")
+	defer tree.Remove()
+	SetExportRefresh(time.Hour)
+	defer SetExportRefresh(60 * time.Second)
+
+	_, nids := getOstAndNidlist()
+	if len(nids["scratch-OST0000"]) != 64 {
+		t.Fatalf("found %d nids", len(nids["scratch-OST0000"]))
+	}
+
+	// client unmounted, exports directory changes
+	if err := os.RemoveAll(tree.Procdir + "obdfilter/scratch-OST0000/exports/10.0.0.1@o2ib"); err != nil {
+		t.Fatal(err)
+	}
+	_, nids = getOstAndNidlist()
+	if len(nids["scratch-OST0000"]) != 63 {
+		t.Errorf("found %d nids after unmount, expected 63", len(nids["scratch-OST0000"]))
+	}
+
+	// OST moved away
+	tree.Sim.Failover("scratch-OST0001", time.Minute)
+	tree.Write()
+	osts, nids := getOstAndNidlist()
+	if len(osts) != 9 || len(nids["scratch-OST0001"]) != 0 {
+		t.Errorf("found OSTs %v during failover", osts)
+	}
+	if _, ok := ostExports.nids["scratch-OST0001"]; ok {
+		t.Errorf("exports of OST in failover still cached")
+	}
+	tree.Advance(2 * time.Minute)
+	if _, nids = getOstAndNidlist(); len(nids["scratch-OST0001"]) != 64 {
+		t.Errorf("found %d nids after failover, expected 64", len(nids["scratch-OST0001"]))
+	}
+}
+
+// differences have to be the counters of the interval, and after a reset the absolute values
+func TestDiff(t *testing.T) {
+	tree := useTree(t, "2.15.3")
+	defer tree.Remove()
+	tree.Advance(150 * time.Second)
+
+	oldOst := readOstValues(getOstAndNidlist())
+	oldMds := readMdsValues(getMdtAndNidlist())
+	tree.Advance(60 * time.Second)
+	curOst := readOstValues(getOstAndNidlist())
+	curMds := readMdsValues(getMdtAndNidlist())
+	ost := diffOstValues(oldOst, curOst)
+	mds := diffMdsValues(oldMds, curMds)
+
+	for _, target := range []string{"scratch-OST0000", "home-OST0001"} {
+		if d := ost.OstTotal[target]; d.WBs != curOst.OstTotal[target].WBs-oldOst.OstTotal[target].WBs || d.WBs == 0 {
+			t.Errorf("%s: difference %v of %v and %v", target, d, curOst.OstTotal[target], oldOst.OstTotal[target])
+		}
+		var sum OstStats
+		for _, stats := range ost.NidValues[target] {
+			sum = sum.add(stats)
+		}
+		if sum.WBs != ost.OstTotal[target].WBs || sum.WRqs != ost.OstTotal[target].WRqs {
+			t.Errorf("%s: nid differences sum up to %v, total is %v", target, sum, ost.OstTotal[target])
+		}
+	}
+	if len(ost.Reset) != 0 || len(mds.Reset) != 0 {
+		t.Errorf("unexpected resets %v %v", ost.Reset, mds.Reset)
+	}
+	if d := mds.MdsTotal["scratch-MDT0000"]["open"]; d != curMds.MdsTotal["scratch-MDT0000"]["open"]-oldMds.MdsTotal["scratch-MDT0000"]["open"] || d == 0 {
+		t.Errorf("MDT difference %d", d)
+	}
+	if times := mds.TotalTimes["scratch-MDT0000"]["open"]; times.Samples != mds.MdsTotal["scratch-MDT0000"]["open"] || times.Avg() == 0 {
+		t.Errorf("MDT service times %v", times)
+	}
+
+	// a nid with first IO counts from zero, but the target was not reset
+	for nid := range oldOst.NidValues["scratch-OST0000"] {
+		delete(oldOst.NidValues["scratch-OST0000"], nid)
+		ost = diffOstValues(oldOst, curOst)
+		if d := ost.NidValues["scratch-OST0000"][nid]; d.WBs != curOst.NidValues["scratch-OST0000"][nid].WBs {
+			t.Errorf("difference of new nid %v, counters %v", d, curOst.NidValues["scratch-OST0000"][nid])
+		}
+		break
+	}
+	for nid := range oldMds.NidValues["scratch-MDT0000"] {
+		delete(oldMds.NidValues["scratch-MDT0000"], nid)
+		mds = diffMdsValues(oldMds, curMds)
+		break
+	}
+	if len(ost.Reset) != 0 || len(mds.Reset) != 0 {
+		t.Errorf("new nids flagged as resets %v %v", ost.Reset, mds.Reset)
+	}
+
+	// failover resets counters, the new counters are the difference
+	tree.Sim.Failover("scratch-OST0002", 30*time.Second)
+	tree.Sim.Failover("scratch-MDT0000", 30*time.Second)
+	oldOst, oldMds = curOst, curMds
+	tree.Advance(60 * time.Second)
+	curOst = readOstValues(getOstAndNidlist())
+	curMds = readMdsValues(getMdtAndNidlist())
+	ost = diffOstValues(oldOst, curOst)
+	mds = diffMdsValues(oldMds, curMds)
+	if !ost.Reset["scratch-OST0002"] || ost.Reset["scratch-OST0003"] || !mds.Reset["scratch-MDT0000"] {
+		t.Errorf("resets %v %v", ost.Reset, mds.Reset)
+	}
+	if d := ost.OstTotal["scratch-OST0002"]; d.WBs != curOst.OstTotal["scratch-OST0002"].WBs || !d.positive() {
+		t.Errorf("difference after failover %v, counters %v", d, curOst.OstTotal["scratch-OST0002"])
+	}
+	if d := mds.MdsTotal["scratch-MDT0000"]; d["open"] != curMds.MdsTotal["scratch-MDT0000"]["open"] || !d.positive() {
+		t.Errorf("difference after failover %v, counters %v", d, curMds.MdsTotal["scratch-MDT0000"])
+	}
+}
+
+// stats files which can not be read keep their previous values, and are part of the next difference
+func TestReadError(t *testing.T) {
+	tree := useTree(t, "2.15.3")
+	defer tree.Remove()
+	tree.Advance(150 * time.Second)
+
+	// files missing for the first snapshot, the next difference has no baseline for them
+	for _, name := range []string{"obdfilter/scratch-OST0002/stats", mdtDevice + "/home-MDT0000/" + mdtStatname} {
+		if err := os.Remove(tree.Procdir + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ossSession, mdsSession int64
+	if err := new(OssRpcT).InitDiff(0, &ossSession); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(MdsRpcT).InitDiff(0, &mdsSession); err != nil {
+		t.Fatal(err)
+	}
+	oldOst := readOstValues(getOstAndNidlist())
+	oldMds := readMdsValues(getMdtAndNidlist())
+	nid := ""
+	for nid = range oldOst.NidValues["scratch-OST0001"] {
+		break
+	}
+
+	tree.Advance(60 * time.Second)
+	for _, name := range []string{"obdfilter/scratch-OST0000/stats", "obdfilter/scratch-OST0001/exports/" + nid + "/stats",
+		mdtDevice + "/scratch-MDT0000/" + mdtStatname} {
+		if err := os.Remove(tree.Procdir + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ost OstValues
+	var mds MdsValues
+	if err := new(OssRpcT).GetValuesDiff(ossSession, &ost); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(MdsRpcT).GetValuesDiff(mdsSession, &mds); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ost.OstTotal["scratch-OST0000"]; ok {
+		t.Errorf("difference of OST which could not be read %v", ost.OstTotal["scratch-OST0000"])
+	}
+	if _, ok := ost.NidValues["scratch-OST0001"][nid]; ok {
+		t.Errorf("difference of nid which could not be read %v", ost.NidValues["scratch-OST0001"][nid])
+	}
+	if _, ok := mds.MdsTotal["scratch-MDT0000"]; ok {
+		t.Errorf("difference of MDT which could not be read %v", mds.MdsTotal["scratch-MDT0000"])
+	}
+	if _, ok := ost.OstTotal["scratch-OST0002"]; ok || ost.Reset["scratch-OST0002"] {
+		t.Errorf("difference of OST without baseline %v", ost.OstTotal["scratch-OST0002"])
+	}
+	if _, ok := mds.MdsTotal["home-MDT0000"]; ok || mds.Reset["home-MDT0000"] {
+		t.Errorf("difference of MDT without baseline %v", mds.MdsTotal["home-MDT0000"])
+	}
+	midOst := readOstValues(getOstAndNidlist())
+	midMds := readMdsValues(getMdtAndNidlist())
+
+	// files are back, the difference covers both intervals
+	tree.Advance(60 * time.Second)
+	if err := new(OssRpcT).GetValuesDiff(ossSession, &ost); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(MdsRpcT).GetValuesDiff(mdsSession, &mds); err != nil {
+		t.Fatal(err)
+	}
+	curOst := readOstValues(getOstAndNidlist())
+	curMds := readMdsValues(getMdtAndNidlist())
+	if len(ost.Reset) != 0 || len(mds.Reset) != 0 {
+		t.Errorf("unexpected resets %v %v", ost.Reset, mds.Reset)
+	}
+	if d := ost.OstTotal["scratch-OST0000"]; d.WBs != curOst.OstTotal["scratch-OST0000"].WBs-oldOst.OstTotal["scratch-OST0000"].WBs {
+		t.Errorf("OST difference %v, counters %v and %v", d, curOst.OstTotal["scratch-OST0000"], oldOst.OstTotal["scratch-OST0000"])
+	}
+	if d := ost.NidValues["scratch-OST0001"][nid]; d.WBs != curOst.NidValues["scratch-OST0001"][nid].WBs-oldOst.NidValues["scratch-OST0001"][nid].WBs {
+		t.Errorf("nid difference %v, counters %v and %v", d, curOst.NidValues["scratch-OST0001"][nid], oldOst.NidValues["scratch-OST0001"][nid])
+	}
+	if d := mds.MdsTotal["scratch-MDT0000"]["open"]; d != curMds.MdsTotal["scratch-MDT0000"]["open"]-oldMds.MdsTotal["scratch-MDT0000"]["open"] {
+		t.Errorf("MDT difference %d, counters %v and %v", d, curMds.MdsTotal["scratch-MDT0000"], oldMds.MdsTotal["scratch-MDT0000"])
+	}
+	// targets missing for the first snapshot have a baseline now
+	if d := ost.OstTotal["scratch-OST0002"]; d.WBs != curOst.OstTotal["scratch-OST0002"].WBs-midOst.OstTotal["scratch-OST0002"].WBs || d.WBs == 0 {
+		t.Errorf("OST difference %v, counters %v and %v", d, curOst.OstTotal["scratch-OST0002"], midOst.OstTotal["scratch-OST0002"])
+	}
+	if d := mds.MdsTotal["home-MDT0000"]; d.Total() != curMds.MdsTotal["home-MDT0000"].Total()-midMds.MdsTotal["home-MDT0000"].Total() {
+		t.Errorf("MDT difference %v, counters %v and %v", d, curMds.MdsTotal["home-MDT0000"], midMds.MdsTotal["home-MDT0000"])
+	}
+}
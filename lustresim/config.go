@@ -0,0 +1,119 @@
+package lustresim
+
+import (
+	"errors"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config describes a simulated lustre installation and the jobs running on it,
+// it can be read from a TOML scenario file with ReadConfig
+type Config struct {
+	Version      string     // lustre version to simulate, changes file formats, like "2.15.3"
+	Seed         int64      // seed for random numbers, same seed gives same counters
+	Clients      int        // number of clients, all clients have exports on all targets
+	Filesystems  []FSConfig // filesystems served, all targets are served by the simulated server
+	Jobs         []JobConfig
+	SlowTargets  []string // targets with ten times the service times, like a degraded raid
+	FailoverRate float64  // failovers per target per hour, counters of a target are reset by a failover
+	FailoverTime int      // seconds a target is gone during failover
+}
+
+// FSConfig describes a filesystem
+type FSConfig struct {
+	Name        string
+	OSTs        int
+	MDTs        int
+	OSTKBytes   int64 // size of each OST in kbytes
+	MDTInodes   int64 // number of inodes of each MDT
+	OSTInodes   int64 // number of inodes of each OST
+	InitialFill int   // percent of space used at start
+}
+
+// JobConfig describes a scripted job, it runs on Clients clients starting at Start,
+// for Duration seconds (0 for endless), and starts again every Period seconds (0 for once)
+//
+// kinds are:
+//
+//	write      streaming writes with 1M rpcs, with Period a checkpointing job
+//	read       streaming reads with 1M rpcs
+//	smallio    4k writes with a sync after each write, like a badly written logger
+//	metadata   creates, opens, stats and unlinks of small files, a metadata storm
+type JobConfig struct {
+	Name      string
+	Kind      string
+	FS        string  // filesystem used, first one if empty
+	Clients   int     // number of clients used by the job
+	Start     int     // seconds after start of simulation
+	Duration  int     // seconds the job is active, 0 for endless
+	Period    int     // seconds after which the job starts again, 0 for once
+	Bandwidth float64 // MB/s per client for write and read
+	Ops       float64 // operations per second per client for smallio and metadata
+	Burst     float64 // maximal factor for random bursts of the rate, 1 or 0 for constant rate
+}
+
+// DefaultConfig returns a scenario with two filesystems and a job of each kind,
+// including a checkpointing job, a metadata storm every 10 minutes and rare failovers
+func DefaultConfig() Config {
+	return Config{
+		Version: "2.15.3",
+		Seed:    1,
+		Clients: 64,
+		Filesystems: []FSConfig{
+			{Name: "scratch", OSTs: 8, MDTs: 1, OSTKBytes: 16 << 30, MDTInodes: 1 << 30, OSTInodes: 1 << 28, InitialFill: 40},
+			{Name: "home", OSTs: 2, MDTs: 1, OSTKBytes: 4 << 30, MDTInodes: 1 << 28, OSTInodes: 1 << 26, InitialFill: 70},
+		},
+		Jobs: []JobConfig{
+			{Name: "stream.1001", Kind: "write", FS: "scratch", Clients: 16, Bandwidth: 200, Burst: 2},
+			{Name: "checkpoint.1002", Kind: "write", FS: "scratch", Clients: 32, Start: 60, Duration: 60, Period: 300, Bandwidth: 500},
+			{Name: "analysis.1003", Kind: "read", FS: "scratch", Clients: 8, Duration: 1800, Period: 3600, Bandwidth: 300, Burst: 3},
+			{Name: "logger.1004", Kind: "smallio", FS: "home", Clients: 4, Ops: 50},
+			{Name: "untar.1005", Kind: "metadata", FS: "scratch", Clients: 8, Start: 120, Duration: 120, Period: 600, Ops: 2000, Burst: 2},
+			{Name: "build.1006", Kind: "metadata", FS: "home", Clients: 2, Ops: 100, Burst: 5},
+		},
+		SlowTargets:  []string{"scratch-OST0005"},
+		FailoverRate: 0.05,
+		FailoverTime: 120,
+	}
+}
+
+// ReadConfig reads a scenario file, values not given are taken from DefaultConfig,
+// filesystems and jobs replace the default ones if given
+func ReadConfig(filename string) (Config, error) {
+	config := DefaultConfig()
+	config.Filesystems = nil
+	config.Jobs = nil
+	config.SlowTargets = nil
+	if _, err := toml.DecodeFile(filename, &config); err != nil {
+		return config, err
+	}
+	if len(config.Filesystems) == 0 {
+		config.Filesystems = DefaultConfig().Filesystems
+	}
+	return config, config.check()
+}
+
+// check config for values the simulation can not handle
+func (c Config) check() error {
+	if c.Clients < 1 {
+		return errors.New("need at least one client")
+	}
+	fsnames := make(map[string]struct{})
+	for _, fs := range c.Filesystems {
+		if fs.Name == "" || fs.OSTs < 0 || fs.MDTs < 0 || fs.OSTs+fs.MDTs == 0 {
+			return errors.New("filesystem needs a name and targets")
+		}
+		fsnames[fs.Name] = struct{}{}
+	}
+	for _, job := range c.Jobs {
+		switch job.Kind {
+		case "write", "read", "smallio", "metadata":
+		default:
+			return errors.New("unknown kind " + job.Kind + " of job " + job.Name + ", use write, read, smallio or metadata")
+		}
+		if _, ok := fsnames[job.FS]; job.FS != "" && !ok {
+			return errors.New("unknown filesystem " + job.FS + " of job " + job.Name)
+		}
+	}
+	return nil
+}
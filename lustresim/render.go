@@ -0,0 +1,307 @@
+package lustresim
+
+// rendering of simulated counters as lustre parameter files, formats and
+// locations differ between lustre versions like on real servers:
+//
+//	1.8        MDT stats in mds/<mdt>/stats, no job_stats, no service times
+//	2.x        MDT stats in mdt/<mdt>/md_stats, job_stats since 2.3
+//	2.10       brw_stats moved from obdfilter to osd-ldiskfs
+//	2.12       service times in usecs for MDT operations and OST reads and writes
+//	2.14       snapshot_time in nsecs, start_time and elapsed_time in stats
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// operations in the order lustre prints them
+var (
+	ostOps = []string{"read_bytes", "write_bytes", "read", "write", "getattr", "setattr", "punch", "sync", "destroy", "create", "statfs"}
+	mdtOps = []string{"open", "close", "mknod", "link", "unlink", "mkdir", "rmdir", "rename", "getattr", "setattr", "getxattr", "setxattr", "statfs", "sync", "samedir_rename", "crossdir_rename"}
+)
+
+// brw_stats histograms with unit and buckets in the order lustre prints them
+var brwHistograms = []struct {
+	name, unit string
+	buckets    []string
+}{
+	{"pages per bulk r/w", "rpcs", []string{"1", "2", "4", "8", "16", "32", "64", "128", "256"}},
+	{"discontiguous pages", "pages", []string{"0", "1"}},
+	{"disk I/O size", "ios", []string{"4K", "8K", "16K", "32K", "64K", "128K", "256K", "512K", "1M"}},
+	{"I/O time (1/1000s)", "ios", []string{"1", "2", "4", "8", "16", "32", "64", "128", "256", "512", "1K"}},
+}
+
+// parse version like "2.15.3" into its numbers, missing numbers are zero
+func parseVersion(version string) []int {
+	numbers := []int{0, 0}
+	for i, s := range strings.Split(version, ".") {
+		v, _ := strconv.Atoi(s)
+		if i < len(numbers) {
+			numbers[i] = v
+		} else {
+			numbers = append(numbers, v)
+		}
+	}
+	return numbers
+}
+
+// AtLeast checks if the simulated version is at least major.minor
+func (s *Sim) AtLeast(major, minor int) bool {
+	return s.version[0] > major || (s.version[0] == major && s.version[1] >= minor)
+}
+
+// Version returns the simulated lustre version
+func (s *Sim) Version() string {
+	return s.config.Version
+}
+
+// VersionFile returns the version file like the simulated lustre version has it
+func (s *Sim) VersionFile() []byte {
+	if s.AtLeast(2, 10) {
+		return []byte(s.config.Version + "\n")
+	}
+	return []byte("lustre: " + s.config.Version + "\nkernel: patchless_client\nbuild: " + s.config.Version + "-sim\n")
+}
+
+// name of the MDT device, mds for 1.8 and mdt for 2.x
+func (s *Sim) mdtDevice() string {
+	if s.AtLeast(2, 0) {
+		return "mdt"
+	}
+	return "mds"
+}
+
+// HasDevice checks if the simulated server has a device like "ost" or "mds"
+func (s *Sim) HasDevice(device string) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, t := range s.targetList() {
+		if (device == "ost" && t.ost) || (device == "mds" && !t.ost) {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets returns names of targets of a device, targets in failover are missing
+func (s *Sim) Targets(device string) []string {
+	s.Lock()
+	defer s.Unlock()
+	list := []string{}
+	for _, t := range s.targetList() {
+		if t.offline.IsZero() && s.hasParams(device, t) {
+			list = append(list, t.name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Exports returns nids having exports on a target, all clients are connected to all targets
+func (s *Sim) Exports(device, target string) []string {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.targets[target]
+	if !ok || !t.offline.IsZero() || !s.hasExports(device, t) {
+		return []string{}
+	}
+	return append([]string{}, s.nids...)
+}
+
+// check if device has a directory for target
+func (s *Sim) hasParams(device string, t *target) bool {
+	switch device {
+	case "obdfilter":
+		return t.ost
+	case "osd-ldiskfs":
+		return s.AtLeast(2, 4)
+	case s.mdtDevice():
+		return !t.ost
+	}
+	return false
+}
+
+// check if device has exports of target
+func (s *Sim) hasExports(device string, t *target) bool {
+	return (device == "obdfilter" && t.ost) || (device == s.mdtDevice() && !t.ost)
+}
+
+// File returns the content of parameter file name of a target of device,
+// name is like "stats" or "exports/<nid>/stats", error if it does not exist
+func (s *Sim) File(device, target, name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	notFound := &os.PathError{Op: "open", Path: device + "/" + target + "/" + name, Err: os.ErrNotExist}
+
+	t, ok := s.targets[target]
+	if !ok || !t.offline.IsZero() || !s.hasParams(device, t) {
+		return nil, notFound
+	}
+
+	if strings.HasPrefix(name, "exports/") && strings.HasSuffix(name, "/stats") {
+		nid := strings.TrimSuffix(strings.TrimPrefix(name, "exports/"), "/stats")
+		if !s.hasExports(device, t) || !s.isNid(nid) {
+			return nil, notFound
+		}
+		return s.renderStats(t, t.exports[nid]), nil
+	}
+
+	switch name {
+	case "stats", "md_stats":
+		// stats of 1.8 MDT and OSTs, md_stats of 2.x MDT
+		if (name == "md_stats") == (!t.ost && s.AtLeast(2, 0)) && s.hasExports(device, t) {
+			return s.renderStats(t, t.stats), nil
+		}
+	case "job_stats":
+		if s.AtLeast(2, 3) && s.hasExports(device, t) {
+			return s.renderJobStats(t), nil
+		}
+	case "brw_stats":
+		if t.ost && (device == "osd-ldiskfs") == s.AtLeast(2, 10) {
+			return s.renderBrwStats(t), nil
+		}
+	case "kbytestotal", "kbytesfree", "filestotal", "filesfree":
+		// OSTs have them in obdfilter as well, MDTs of 2.x only in the osd
+		if device == "osd-ldiskfs" || t.ost || !s.AtLeast(2, 0) {
+			i := map[string]int{"kbytestotal": 0, "kbytesfree": 1, "filestotal": 2, "filesfree": 3}[name]
+			return []byte(fmt.Sprintf("%d\n", t.capacity[i])), nil
+		}
+	}
+	return nil, notFound
+}
+
+func (s *Sim) isNid(nid string) bool {
+	for _, n := range s.nids {
+		if n == nid {
+			return true
+		}
+	}
+	return false
+}
+
+// check if an operation has service times in the simulated version
+func (s *Sim) timed(t *target, op string) bool {
+	if !s.AtLeast(2, 12) {
+		return false
+	}
+	return !t.ost || (op != "read_bytes" && op != "write_bytes")
+}
+
+// render a stats file with counters, counters without samples are not printed
+func (s *Sim) renderStats(t *target, counters opCounters) []byte {
+	var b bytes.Buffer
+	if s.AtLeast(2, 14) {
+		fmt.Fprintf(&b, "%-25s %d.%09d secs.nsecs\n", "snapshot_time", s.now.Unix(), s.now.Nanosecond())
+		fmt.Fprintf(&b, "%-25s %d.%09d secs.nsecs\n", "start_time", s.start.Unix(), s.start.Nanosecond())
+		elapsed := s.now.Sub(s.start)
+		fmt.Fprintf(&b, "%-25s %d.%09d secs.nsecs\n", "elapsed_time", int64(elapsed.Seconds()), elapsed.Nanoseconds()%1000000000)
+	} else {
+		fmt.Fprintf(&b, "%-25s %d.%06d secs.usecs\n", "snapshot_time", s.now.Unix(), s.now.Nanosecond()/1000)
+	}
+
+	ops := mdtOps
+	if t.ost {
+		ops = ostOps
+	}
+	for _, op := range ops {
+		c, ok := counters[op]
+		if !ok || c.samples == 0 {
+			continue
+		}
+		if op == "read_bytes" || op == "write_bytes" {
+			fmt.Fprintf(&b, "%-25s %d samples [bytes] %d %d %d", op, c.samples, c.min, c.max, c.sum)
+			if s.AtLeast(2, 0) {
+				fmt.Fprintf(&b, " %d", c.sumsq)
+			}
+			b.WriteString("\n")
+		} else if s.timed(t, op) {
+			fmt.Fprintf(&b, "%-25s %d samples [usecs] %d %d %d %d\n", op, c.samples, c.min, c.max, c.sum, c.sumsq)
+		} else if op != "read" && op != "write" {
+			// reads and writes without times are only counted in read_bytes and write_bytes
+			fmt.Fprintf(&b, "%-25s %d samples [reqs]\n", op, c.samples)
+		}
+	}
+	return b.Bytes()
+}
+
+// render job_stats, all operations of a job are printed, also those without samples
+func (s *Sim) renderJobStats(t *target) []byte {
+	var b bytes.Buffer
+	b.WriteString("job_stats:\n")
+
+	jobs := []string{}
+	for job := range t.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+
+	ops := mdtOps
+	if t.ost {
+		ops = ostOps
+	}
+	for _, job := range jobs {
+		fmt.Fprintf(&b, "- job_id:          %s\n", job)
+		fmt.Fprintf(&b, "  snapshot_time:   %d\n", s.now.Unix())
+		for _, op := range ops {
+			c, ok := t.jobs[job][op]
+			if !ok {
+				c = new(counter)
+			}
+			name := fmt.Sprintf("%-16s", op+":")
+			if op == "read_bytes" || op == "write_bytes" {
+				fmt.Fprintf(&b, "  %s { samples: %11d, unit: bytes, min: %7d, max: %7d, sum: %15d }\n", name, c.samples, c.min, c.max, c.sum)
+			} else if s.timed(t, op) {
+				fmt.Fprintf(&b, "  %s { samples: %11d, unit: usecs, min: %7d, max: %7d, sum: %15d, sumsq: %20d }\n", name, c.samples, c.min, c.max, c.sum, c.sumsq)
+			} else if op != "read" && op != "write" {
+				fmt.Fprintf(&b, "  %s { samples: %11d, unit:  reqs }\n", name, c.samples)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// render brw_stats, buckets are printed up to the last one which is not empty
+func (s *Sim) renderBrwStats(t *target) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "snapshot_time:         %d.%06d (secs.usecs)\n", s.now.Unix(), s.now.Nanosecond()/1000)
+	for _, h := range brwHistograms {
+		var total [2]int64
+		last := -1
+		for i, bucket := range h.buckets {
+			if v, ok := t.brw[h.name][bucket]; ok {
+				total[0] += v[0]
+				total[1] += v[1]
+				if v[0] != 0 || v[1] != 0 {
+					last = i
+				}
+			}
+		}
+
+		b.WriteString("\n                           read      |     write\n")
+		fmt.Fprintf(&b, "%-22s %-5s %% cum %% |  %-5s       %% cum %%\n", h.name, h.unit, h.unit)
+		var cum [2]int64
+		for _, bucket := range h.buckets[:last+1] {
+			var v [2]int64
+			if p, ok := t.brw[h.name][bucket]; ok {
+				v = *p
+			}
+			cum[0] += v[0]
+			cum[1] += v[1]
+			fmt.Fprintf(&b, "%-22s %4d %3d %3d   | %4d %3d %3d\n", bucket+":",
+				v[0], percent(v[0], total[0]), percent(cum[0], total[0]),
+				v[1], percent(v[1], total[1]), percent(cum[1], total[1]))
+		}
+	}
+	return b.Bytes()
+}
+
+func percent(v, total int64) int64 {
+	if total == 0 {
+		return 0
+	}
+	return v * 100 / total
+}
@@ -0,0 +1,467 @@
+// Package lustresim simulates the performance counters of a lustre server,
+// with filesystems, OSTs, MDTs and clients running scripted jobs, for testing
+// and demonstrating ludalo without a lustre installation.
+// Counters are kept like lustre does, as absolute values for each target,
+// each export (nid) and each job, so totals of a target are the sum of its nids,
+// and are rendered in the file formats of the simulated lustre version.
+// Time advances in steps of one second, with the wall clock (Update)
+// or explicitly (Advance).
+package lustresim
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// at most this many seconds are simulated at once, longer pauses are skipped
+const maxSteps = 3600
+
+// one counter of a stats file, number of samples and min, max, sum and
+// sum of squares of their values (bytes or usecs)
+type counter struct {
+	samples, min, max, sum, sumsq int64
+}
+
+// add n samples with value each
+func (c *counter) add(n, value int64) {
+	if n <= 0 {
+		return
+	}
+	if c.samples == 0 || value < c.min {
+		c.min = value
+	}
+	if value > c.max {
+		c.max = value
+	}
+	c.samples += n
+	c.sum += n * value
+	c.sumsq += n * value * value
+}
+
+// counters of all operations of a target, an export or a job
+type opCounters map[string]*counter
+
+func (o opCounters) add(op string, n, value int64) {
+	c, ok := o[op]
+	if !ok {
+		c = new(counter)
+		o[op] = c
+	}
+	c.add(n, value)
+}
+
+// brw_stats histograms, read and write counts for each bucket
+type histograms map[string]map[string]*[2]int64
+
+func (h histograms) add(name, bucket string, write bool, n int64) {
+	if h[name] == nil {
+		h[name] = make(map[string]*[2]int64)
+	}
+	b, ok := h[name][bucket]
+	if !ok {
+		b = new([2]int64)
+		h[name][bucket] = b
+	}
+	if write {
+		b[1] += n
+	} else {
+		b[0] += n
+	}
+}
+
+// a simulated OST or MDT
+type target struct {
+	name     string
+	fs       string
+	ost      bool
+	slow     bool      // service times are ten times longer
+	offline  time.Time // target is gone during failover until then, zero if online
+	load     int64     // requests in last step, service times grow with load
+	requests int64     // requests in current step
+	stats    opCounters
+	exports  map[string]opCounters
+	jobs     map[string]opCounters
+	brw      histograms
+	capacity [4]int64 // kbytes total and free, files total and free
+}
+
+// clear all counters, like after a failover, capacity stays
+func (t *target) reset() {
+	t.stats = make(opCounters)
+	t.exports = make(map[string]opCounters)
+	t.jobs = make(map[string]opCounters)
+	t.brw = make(histograms)
+	t.load = 0
+	t.requests = 0
+}
+
+// count n requests of operation op with value (bytes or usecs) from nid for job
+func (t *target) record(nid, job, op string, n, value int64) {
+	if n <= 0 {
+		return
+	}
+	t.stats.add(op, n, value)
+	if t.exports[nid] == nil {
+		t.exports[nid] = make(opCounters)
+	}
+	t.exports[nid].add(op, n, value)
+	if job != "" {
+		if t.jobs[job] == nil {
+			t.jobs[job] = make(opCounters)
+		}
+		t.jobs[job].add(op, n, value)
+	}
+	t.requests += n
+}
+
+// a simulated filesystem
+type filesystem struct {
+	name string
+	osts []*target
+	mdts []*target
+}
+
+// Sim is a simulated lustre server, serving all targets of all filesystems of its config
+type Sim struct {
+	sync.Mutex
+	config  Config
+	version []int
+	rand    *rand.Rand
+	start   time.Time // start of simulation, jobs start relative to it
+	now     time.Time // simulated time, always start plus whole seconds
+	nids    []string
+	fs      []*filesystem
+	targets map[string]*target
+	bursts  []float64 // current rate factor of each job
+}
+
+// New creates a simulation starting now, with all counters zero
+func New(config Config) (*Sim, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	s := new(Sim)
+	s.config = config
+	s.version = parseVersion(config.Version)
+	s.rand = rand.New(rand.NewSource(config.Seed))
+	s.start = time.Now().Truncate(time.Second)
+	s.now = s.start
+	s.targets = make(map[string]*target)
+
+	for i := 0; i < config.Clients; i++ {
+		s.nids = append(s.nids, fmt.Sprintf("10.0.%d.%d@o2ib", i/250, i%250+1))
+	}
+
+	slow := make(map[string]struct{})
+	for _, t := range config.SlowTargets {
+		slow[t] = struct{}{}
+	}
+	for _, fc := range config.Filesystems {
+		fs := &filesystem{name: fc.Name}
+		for i := 0; i < fc.OSTs; i++ {
+			t := s.newTarget(fmt.Sprintf("%s-OST%04x", fc.Name, i), fc.Name, true)
+			t.capacity = [4]int64{fc.OSTKBytes, fc.OSTKBytes * int64(100-fc.InitialFill) / 100, fc.OSTInodes, fc.OSTInodes * int64(100-fc.InitialFill) / 100}
+			fs.osts = append(fs.osts, t)
+		}
+		for i := 0; i < fc.MDTs; i++ {
+			t := s.newTarget(fmt.Sprintf("%s-MDT%04x", fc.Name, i), fc.Name, false)
+			// MDT size does not matter much, inodes do
+			t.capacity = [4]int64{fc.MDTInodes * 4, fc.MDTInodes * 4 * int64(100-fc.InitialFill) / 100, fc.MDTInodes, fc.MDTInodes * int64(100-fc.InitialFill) / 100}
+			fs.mdts = append(fs.mdts, t)
+		}
+		s.fs = append(s.fs, fs)
+	}
+	for name := range slow {
+		if t, ok := s.targets[name]; ok {
+			t.slow = true
+		}
+	}
+
+	s.bursts = make([]float64, len(config.Jobs))
+	for i := range s.bursts {
+		s.bursts[i] = 1.0
+	}
+	return s, nil
+}
+
+func (s *Sim) newTarget(name, fs string, ost bool) *target {
+	t := &target{name: name, fs: fs, ost: ost}
+	t.reset()
+	s.targets[name] = t
+	return t
+}
+
+// Update advances the simulation to the current time
+func (s *Sim) Update() {
+	s.Lock()
+	defer s.Unlock()
+	s.advanceTo(time.Now())
+}
+
+// Advance advances the simulation by d, independent of the wall clock, for tests
+func (s *Sim) Advance(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.advanceTo(s.now.Add(d))
+}
+
+// Now returns the simulated time
+func (s *Sim) Now() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.now
+}
+
+// Failover moves target away for d, its counters are reset, false if there is no such target
+func (s *Sim) Failover(name string, d time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.targets[name]
+	if !ok {
+		return false
+	}
+	t.offline = s.now.Add(d)
+	t.reset()
+	return true
+}
+
+func (s *Sim) advanceTo(t time.Time) {
+	steps := int(t.Sub(s.now) / time.Second)
+	if steps > maxSteps {
+		// nobody looked for a long time, nothing happened in between
+		s.now = s.now.Add(time.Duration(steps-maxSteps) * time.Second)
+		steps = maxSteps
+	}
+	for i := 0; i < steps; i++ {
+		s.step()
+	}
+}
+
+// simulate one second
+func (s *Sim) step() {
+	s.now = s.now.Add(time.Second)
+	elapsed := int(s.now.Sub(s.start) / time.Second)
+
+	// targets in fixed order, so the same seed gives the same failovers
+	for _, t := range s.targetList() {
+		t.load = t.requests
+		t.requests = 0
+		if !t.offline.IsZero() {
+			if !s.now.Before(t.offline) {
+				// back on this server, with fresh counters
+				t.offline = time.Time{}
+			}
+		} else if s.rand.Float64() < s.config.FailoverRate/3600.0 {
+			t.offline = s.now.Add(time.Duration(s.config.FailoverTime) * time.Second)
+			t.reset()
+		}
+	}
+
+	for i, job := range s.config.Jobs {
+		if !active(job, elapsed) {
+			continue
+		}
+		if elapsed%10 == 0 {
+			s.bursts[i] = 1.0
+			if job.Burst > 1.0 && s.rand.Float64() < 0.3 {
+				s.bursts[i] = 1.0 + s.rand.Float64()*(job.Burst-1.0)
+			}
+		}
+		fs := s.jobFilesystem(job)
+		for c := 0; c < job.Clients; c++ {
+			// jobs use different clients as long as there are enough
+			client := (i*16 + c) % len(s.nids)
+			switch job.Kind {
+			case "write", "read":
+				s.streamIO(fs, job, s.nids[client], client+elapsed, s.count(job.Bandwidth*s.bursts[i]))
+			case "smallio":
+				s.smallIO(fs, job, s.nids[client], client, s.count(job.Ops*s.bursts[i]))
+			case "metadata":
+				s.metadata(fs, job, s.nids[client], client, s.count(job.Ops*s.bursts[i]))
+			}
+		}
+	}
+}
+
+// all targets of all filesystems, OSTs first
+func (s *Sim) targetList() []*target {
+	list := []*target{}
+	for _, fs := range s.fs {
+		list = append(list, fs.osts...)
+	}
+	for _, fs := range s.fs {
+		list = append(list, fs.mdts...)
+	}
+	return list
+}
+
+// check if job runs elapsed seconds after start of simulation
+func active(job JobConfig, elapsed int) bool {
+	t := elapsed - job.Start
+	if t < 0 {
+		return false
+	}
+	if job.Period > 0 {
+		t = t % job.Period
+	}
+	return job.Duration == 0 || t < job.Duration
+}
+
+func (s *Sim) jobFilesystem(job JobConfig) *filesystem {
+	for _, fs := range s.fs {
+		if fs.name == job.FS {
+			return fs
+		}
+	}
+	return s.fs[0]
+}
+
+// round a rate randomly to an integer count, keeping the average
+func (s *Sim) count(rate float64) int64 {
+	n := int64(rate)
+	if s.rand.Float64() < rate-float64(n) {
+		n++
+	}
+	return n
+}
+
+// service time in usecs of an operation with base time in usecs,
+// growing with load of the target
+func (s *Sim) latency(t *target, base int64) int64 {
+	v := float64(base) * (1.0 + float64(t.load)/2000.0) * (0.8 + 0.4*s.rand.Float64())
+	if t.slow {
+		v *= 10.0
+	}
+	return int64(v) + 1
+}
+
+// streaming IO of a client with rpcs rpcs of 1M, striped over all OSTs
+func (s *Sim) streamIO(fs *filesystem, job JobConfig, nid string, offset int, rpcs int64) {
+	n := int64(len(fs.osts))
+	if n == 0 || rpcs == 0 {
+		return
+	}
+	write := job.Kind == "write"
+	for k, t := range fs.osts {
+		m := rpcs / n
+		if int64((k-offset%len(fs.osts)+len(fs.osts))%len(fs.osts)) < rpcs%n {
+			m++
+		}
+		if m == 0 || !t.offline.IsZero() {
+			continue
+		}
+		lat := s.latency(t, 5000)
+		if write {
+			t.record(nid, job.Name, "write_bytes", m, 1<<20)
+			t.record(nid, job.Name, "write", m, lat)
+			s.useSpace(t, m*1024, 0)
+		} else {
+			t.record(nid, job.Name, "read_bytes", m, 1<<20)
+			t.record(nid, job.Name, "read", m, lat)
+		}
+		s.brw(t, write, 256, m, lat)
+	}
+}
+
+// small synchronous writes of a client, to a single OST
+func (s *Sim) smallIO(fs *filesystem, job JobConfig, nid string, client int, ops int64) {
+	if len(fs.osts) == 0 || ops == 0 {
+		return
+	}
+	t := fs.osts[client%len(fs.osts)]
+	if !t.offline.IsZero() {
+		return
+	}
+	lat := s.latency(t, 500)
+	t.record(nid, job.Name, "write_bytes", ops, 4096)
+	t.record(nid, job.Name, "write", ops, lat)
+	t.record(nid, job.Name, "sync", ops, s.latency(t, 2000))
+	t.record(nid, job.Name, "punch", s.count(float64(ops)/10.0), s.latency(t, 300))
+	t.record(nid, job.Name, "setattr", s.count(float64(ops)/10.0), s.latency(t, 100))
+	s.useSpace(t, ops*4, 0)
+	s.brw(t, true, 1, ops, lat)
+}
+
+// metadata operations of a client, creating and removing small files
+func (s *Sim) metadata(fs *filesystem, job JobConfig, nid string, client int, ops int64) {
+	if len(fs.mdts) == 0 || ops == 0 {
+		return
+	}
+	t := fs.mdts[client%len(fs.mdts)]
+	if !t.offline.IsZero() {
+		return
+	}
+	part := func(f float64) int64 { return s.count(float64(ops) * f) }
+	creates := part(0.25)
+	unlinks := part(0.25)
+	t.record(nid, job.Name, "open", ops, s.latency(t, 100))
+	t.record(nid, job.Name, "close", ops, s.latency(t, 50))
+	t.record(nid, job.Name, "getattr", ops, s.latency(t, 30))
+	t.record(nid, job.Name, "mknod", creates, s.latency(t, 300))
+	t.record(nid, job.Name, "unlink", unlinks, s.latency(t, 250))
+	t.record(nid, job.Name, "setattr", part(0.1), s.latency(t, 80))
+	t.record(nid, job.Name, "getxattr", part(0.1), s.latency(t, 40))
+	t.record(nid, job.Name, "mkdir", part(0.02), s.latency(t, 300))
+	t.record(nid, job.Name, "rmdir", part(0.02), s.latency(t, 250))
+	t.record(nid, job.Name, "samedir_rename", part(0.01), s.latency(t, 400))
+	t.record(nid, job.Name, "statfs", part(0.01), s.latency(t, 20))
+	s.useSpace(t, (creates-unlinks)*4, creates-unlinks)
+
+	// clients ask OSTs for free space now and then
+	for _, ost := range fs.osts {
+		if ost.offline.IsZero() {
+			ost.record(nid, job.Name, "statfs", part(0.001), s.latency(ost, 20))
+		}
+	}
+}
+
+// account kbytes and files used on a target, a full target is purged
+// back to its initial fill level
+func (s *Sim) useSpace(t *target, kbytes, files int64) {
+	t.capacity[1] -= kbytes
+	t.capacity[3] -= files
+	if t.capacity[1] < t.capacity[0]/100 || t.capacity[3] < t.capacity[2]/100 {
+		for _, fc := range s.config.Filesystems {
+			if fc.Name == t.fs {
+				t.capacity[1] = t.capacity[0] * int64(100-fc.InitialFill) / 100
+				t.capacity[3] = t.capacity[2] * int64(100-fc.InitialFill) / 100
+			}
+		}
+	}
+	if t.capacity[1] > t.capacity[0] {
+		t.capacity[1] = t.capacity[0]
+	}
+	if t.capacity[3] > t.capacity[2] {
+		t.capacity[3] = t.capacity[2]
+	}
+}
+
+// account n rpcs of pages pages with service time lat in usecs in brw_stats
+func (s *Sim) brw(t *target, write bool, pages, n, lat int64) {
+	t.brw.add("pages per bulk r/w", fmt.Sprint(pages), write, n)
+	t.brw.add("discontiguous pages", "0", write, n)
+	t.brw.add("disk I/O size", sizeBucket(pages*4096), write, n)
+	ms := int64(1)
+	for ms*1000 < lat && ms < 1024 {
+		ms *= 2
+	}
+	t.brw.add("I/O time (1/1000s)", timeBucket(ms), write, n)
+}
+
+// bucket name of a size in bytes, like 4K or 1M
+func sizeBucket(size int64) string {
+	if size >= 1<<20 {
+		return fmt.Sprintf("%dM", size>>20)
+	}
+	return fmt.Sprintf("%dK", size>>10)
+}
+
+// bucket name of a time in ms, like 16 or 1K
+func timeBucket(ms int64) string {
+	if ms >= 1024 {
+		return fmt.Sprintf("%dK", ms>>10)
+	}
+	return fmt.Sprint(ms)
+}
@@ -0,0 +1,129 @@
+// migrate converts a ludalo database to the schema version of the aggregator,
+// stop the aggregator before, migrate can be interrupted and run again
+//
+// version 1 to 2: counters in v stored as float32 become int64, values already
+// rounded by float32 can not be recovered, but all documents get the same format
+
+package main
+
+import (
+	"flag"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// schemaVersion is the format written by the aggregator, has to match aggregator
+const schemaVersion = 2
+
+// the part of ludalo.config we need
+type configT struct {
+	Database struct {
+		Server string
+		Name   string
+	}
+}
+
+// schemaDoc is the document in collection schema, like in aggregator
+type schemaDoc struct {
+	ID      string `bson:"_id"`
+	Version int    `bson:"version"`
+	Ts      int64  `bson:"ts"`
+}
+
+func main() {
+	config := flag.String("config", "ludalo.config", "config file of aggregator")
+	dryrun := flag.Bool("n", false, "only count documents to convert")
+	flag.Parse()
+
+	var conf configT
+	if _, err := toml.DecodeFile(*config, &conf); err != nil {
+		log.Print("error in reading " + *config + ":")
+		log.Fatal(err)
+	}
+
+	session, err := mgo.Dial(conf.Database.Server)
+	if err != nil {
+		log.Print("could not connected to mongo server " + conf.Database.Server)
+		log.Fatal(err)
+	}
+	defer session.Close()
+	session.SetSafe(&mgo.Safe{})
+	db := session.DB(conf.Database.Name)
+
+	var doc schemaDoc
+	err = db.C("schema").FindId("ludalo").One(&doc)
+	if err == nil && doc.Version >= schemaVersion {
+		log.Print("database ", conf.Database.Name, " has schema version ", doc.Version, ", nothing to do")
+		return
+	} else if err != nil && err != mgo.ErrNotFound {
+		log.Fatal(err)
+	}
+
+	names, err := db.CollectionNames()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var total int
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") || name == "schema" {
+			continue
+		}
+		n, err := convertCollection(db.C(name), *dryrun)
+		if err != nil {
+			log.Print("error in converting ", name, " after ", n, " documents, run migrate again")
+			log.Fatal(err)
+		}
+		if n > 0 {
+			log.Print(name, ": ", n, " documents converted")
+		}
+		total += n
+	}
+
+	if *dryrun {
+		log.Print(total, " documents to convert")
+		return
+	}
+	_, err = db.C("schema").UpsertId("ludalo", schemaDoc{"ludalo", schemaVersion, time.Now().Unix()})
+	if err != nil {
+		log.Print("could not record schema version")
+		log.Fatal(err)
+	}
+	log.Print(total, " documents converted, database ", conf.Database.Name, " has schema version ", schemaVersion)
+}
+
+// convert counters in v of all documents of c from float to int64,
+// returns number of converted documents
+func convertCollection(c *mgo.Collection, dryrun bool) (int, error) {
+	// type 1 is double, documents already converted are not found again
+	query := c.Find(bson.M{"v.0": bson.M{"$type": 1}})
+	if dryrun {
+		return query.Count()
+	}
+
+	var doc struct {
+		ID interface{} `bson:"_id"`
+		V  []float64   `bson:"v"`
+	}
+	count := 0
+	iter := query.Select(bson.M{"v": 1}).Iter()
+	for iter.Next(&doc) {
+		vals := make([]int64, len(doc.V))
+		for i, v := range doc.V {
+			vals[i] = int64(math.Floor(v + 0.5))
+		}
+		if err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"v": vals}}); err != nil {
+			iter.Close()
+			return count, err
+		}
+		count++
+		if count%100000 == 0 {
+			log.Print(c.Name, ": ", count, " documents")
+		}
+	}
+	return count, iter.Close()
+}
@@ -0,0 +1,142 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record is one line of the files of File
+type Record struct {
+	Op         string                 `json:"op"` // insert, upsert or update
+	Collection string                 `json:"c"`
+	Doc        interface{}            `json:"doc,omitempty"` // inserted document
+	Selector   map[string]interface{} `json:"sel,omitempty"`
+	Fields     map[string]interface{} `json:"set,omitempty"`
+}
+
+// File writes documents as JSON lines into files in a directory, a new file
+// is started when the current one reaches a size or an age, old files are
+// not removed
+type File struct {
+	lock    sync.Mutex
+	dir     string
+	maxSize int64         // bytes, 0 is unlimited
+	maxAge  time.Duration // 0 is unlimited
+
+	f      *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+	seq    int // files started by this sink, keeps names unique within a second
+}
+
+// NewFile writes into directory dir, created if missing, with a new file after
+// maxSize bytes or after maxAge
+func NewFile(dir string, maxSize int64, maxAge time.Duration) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &File{dir: dir, maxSize: maxSize, maxAge: maxAge}, nil
+}
+
+// Name returns the name of the current file, empty if nothing was written yet
+func (f *File) Name() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.f == nil {
+		return ""
+	}
+	return f.f.Name()
+}
+
+// Insert appends a line for each document
+func (f *File) Insert(collection string, docs []interface{}) error {
+	records := make([]Record, len(docs))
+	for i, doc := range docs {
+		records[i] = Record{Op: "insert", Collection: collection, Doc: doc}
+	}
+	return f.write(records)
+}
+
+// Upsert appends a line with selector and fields, a reader has to apply it
+func (f *File) Upsert(collection string, selector, fields map[string]interface{}) error {
+	return f.write([]Record{{Op: "upsert", Collection: collection, Selector: selector, Fields: fields}})
+}
+
+// Update appends a line like Upsert, a reader must not insert a document
+func (f *File) Update(collection string, selector, fields map[string]interface{}) error {
+	return f.write([]Record{{Op: "update", Collection: collection, Selector: selector, Fields: fields}})
+}
+
+// Remove does nothing, the files are an archive
+func (f *File) Remove(collection string, selector map[string]interface{}) error {
+	return nil
+}
+
+// Close closes the current file
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closeFile()
+}
+
+// write records to the current file, all records of one call go into the same file
+func (f *File) write(records []Record) error {
+	lines := make([]byte, 0, 256*len(records))
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.f != nil && ((f.maxSize > 0 && f.size >= f.maxSize) || (f.maxAge > 0 && time.Since(f.opened) >= f.maxAge)) {
+		if err := f.closeFile(); err != nil {
+			return err
+		}
+	}
+	if f.f == nil {
+		if err := f.openFile(); err != nil {
+			return err
+		}
+	}
+	n, err := f.w.Write(lines)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	// a line is either complete in the file or not there after a crash
+	return f.w.Flush()
+}
+
+func (f *File) openFile() error {
+	now := time.Now()
+	f.seq++
+	name := filepath.Join(f.dir, fmt.Sprintf("ludalo-%s-%d.jsonl", now.Format("20060102-150405"), f.seq))
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	f.f, f.w, f.size, f.opened = file, bufio.NewWriter(file), 0, now
+	return nil
+}
+
+func (f *File) closeFile() error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.w.Flush()
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	f.f, f.w = nil, nil
+	return err
+}
@@ -0,0 +1,181 @@
+package sink
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Memory keeps all documents in memory, for tests
+type Memory struct {
+	lock        sync.Mutex
+	collections map[string][]interface{}
+}
+
+// NewMemory returns an empty Memory
+func NewMemory() *Memory {
+	return &Memory{collections: make(map[string][]interface{})}
+}
+
+// Insert appends documents to collection, documents with an _id which is
+// already there are skipped, like duplicate keys in mongo
+func (m *Memory) Insert(collection string, docs []interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ids := make(map[interface{}]struct{})
+	for _, doc := range m.collections[collection] {
+		if d, ok := asMap(doc); ok && d["_id"] != nil {
+			ids[d["_id"]] = struct{}{}
+		}
+	}
+	for _, doc := range docs {
+		if d, ok := asMap(doc); ok && d["_id"] != nil {
+			if _, dup := ids[d["_id"]]; dup {
+				continue
+			}
+			ids[d["_id"]] = struct{}{}
+		}
+		m.collections[collection] = append(m.collections[collection], doc)
+	}
+	return nil
+}
+
+// Upsert sets fields in the first document matching selector, selectors can
+// compare values or test fields with $exists
+func (m *Memory) Upsert(collection string, selector, fields map[string]interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, doc := range m.collections[collection] {
+		if d, ok := asMap(doc); ok && matches(d, selector) {
+			// a new map, documents returned by Docs do not change
+			m.collections[collection][i] = merge(d, fields)
+			return nil
+		}
+	}
+	// like mongo, the new document gets the values compared in selector
+	doc := make(map[string]interface{})
+	for k, v := range selector {
+		if _, isMap := asMap(v); !isMap {
+			doc[k] = v
+		}
+	}
+	m.collections[collection] = append(m.collections[collection], merge(doc, fields))
+	return nil
+}
+
+// Update sets fields in the first document matching selector, like Upsert,
+// but without one nothing is inserted
+func (m *Memory) Update(collection string, selector, fields map[string]interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, doc := range m.collections[collection] {
+		if d, ok := asMap(doc); ok && matches(d, selector) {
+			m.collections[collection][i] = merge(d, fields)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Remove deletes the documents matching selector
+func (m *Memory) Remove(collection string, selector map[string]interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	kept := []interface{}{}
+	for _, doc := range m.collections[collection] {
+		if d, ok := asMap(doc); !ok || !matches(d, selector) {
+			kept = append(kept, doc)
+		}
+	}
+	m.collections[collection] = kept
+	return nil
+}
+
+// Close does nothing, documents stay readable
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Collections returns the sorted names of all collections
+func (m *Memory) Collections() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.collections))
+	for name := range m.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Docs returns the documents of collection in order of insertion
+func (m *Memory) Docs(collection string) []interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]interface{}(nil), m.collections[collection]...)
+}
+
+// copy of doc with fields set
+func merge(doc, fields map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(doc)+len(fields))
+	for k, v := range doc {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case bson.M:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	return nil, false
+}
+
+// does doc match selector, only equality, $exists and $lt of numbers are known
+func matches(doc, selector map[string]interface{}) bool {
+	for k, cond := range selector {
+		value, ok := doc[k]
+		if c, isMap := asMap(cond); isMap {
+			if exists, has := c["$exists"]; has {
+				if ok != (exists == true) {
+					return false
+				}
+				continue
+			}
+			if limit, has := c["$lt"]; has {
+				v, vok := number(value)
+				l, lok := number(limit)
+				if !vok || !lok || v >= l {
+					return false
+				}
+				continue
+			}
+		}
+		if !ok || !reflect.DeepEqual(value, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,158 @@
+package sink
+
+import (
+	"log"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mongo writes documents into a MongoDB database, with bulk inserts
+type Mongo struct {
+	session *mgo.Session
+	name    string
+	indexes func(collection string) []string
+
+	lock    sync.Mutex
+	indexed map[string]struct{} // collections where indexes were created
+}
+
+// NewMongo connects to database name on server, indexes gives the keys of the
+// index of a collection, which is created when a collection is used the first
+// time, nil for no indexes
+func NewMongo(server, name string, indexes func(collection string) []string) (*Mongo, error) {
+	session, err := mgo.Dial(server)
+	if err != nil {
+		return nil, err
+	}
+	session.SetSafe(&mgo.Safe{})
+	return &Mongo{session: session, name: name, indexes: indexes, indexed: make(map[string]struct{})}, nil
+}
+
+// DB returns the database, for access beyond documents like schema checks
+func (m *Mongo) DB() *mgo.Database {
+	return m.session.DB(m.name)
+}
+
+// get collection name within session s, creating its index if it was not used before
+func (m *Mongo) collection(s *mgo.Session, name string) *mgo.Collection {
+	c := s.DB(m.name).C(name)
+	m.lock.Lock()
+	_, ok := m.indexed[name]
+	m.indexed[name] = struct{}{}
+	m.lock.Unlock()
+	if !ok && m.indexes != nil {
+		if keys := m.indexes(name); len(keys) > 0 {
+			// in background, on existing collections this can take long
+			if err := c.EnsureIndex(mgo.Index{Key: keys, Background: true}); err != nil {
+				log.Println("WARNING: could not create index on", name)
+				log.Println(err)
+				// try again with next use, e.g. database was down
+				m.lock.Lock()
+				delete(m.indexed, name)
+				m.lock.Unlock()
+			}
+		}
+	}
+	return c
+}
+
+// Insert stores documents with one unordered bulk operation,
+// one bad document does not stop the others, duplicate keys are no error,
+// the documents were written before, e.g. by a bulk which failed partly
+func (m *Mongo) Insert(collection string, docs []interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	s := m.session.Clone()
+	defer s.Close()
+	bulk := m.collection(s, collection).Bulk()
+	bulk.Unordered()
+	bulk.Insert(docs...)
+	_, err := bulk.Run()
+	if mgo.IsDup(err) {
+		return nil
+	}
+	if err != nil {
+		// next try with a new connection
+		m.session.Refresh()
+	}
+	return rejected(err)
+}
+
+// Upsert updates the document matching selector with $set of fields
+func (m *Mongo) Upsert(collection string, selector, fields map[string]interface{}) error {
+	s := m.session.Clone()
+	defer s.Close()
+	_, err := m.collection(s, collection).Upsert(bson.M(selector), bson.M{"$set": bson.M(fields)})
+	if err != nil {
+		m.session.Refresh()
+	}
+	return rejected(err)
+}
+
+// Update updates the document matching selector with $set of fields,
+// a missing document is no error
+func (m *Mongo) Update(collection string, selector, fields map[string]interface{}) error {
+	s := m.session.Clone()
+	defer s.Close()
+	err := m.collection(s, collection).Update(bson.M(selector), bson.M{"$set": bson.M(fields)})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		m.session.Refresh()
+	}
+	return rejected(err)
+}
+
+// Remove deletes the documents matching selector
+func (m *Mongo) Remove(collection string, selector map[string]interface{}) error {
+	s := m.session.Clone()
+	defer s.Close()
+	_, err := s.DB(m.name).C(collection).RemoveAll(bson.M(selector))
+	if err != nil {
+		m.session.Refresh()
+	}
+	return rejected(err)
+}
+
+// Close closes the connection
+func (m *Mongo) Close() error {
+	m.session.Close()
+	return nil
+}
+
+// code of errors for documents failing validation of the collection
+const codeValidation = 121
+
+// duplicate keys and failed validation are Rejected, bulk errors only if all
+// cases are, other errors like not master during a failover go away
+func rejected(err error) error {
+	if err != nil && permanent(err) {
+		return &Rejected{err}
+	}
+	return err
+}
+
+// check if writing again fails again
+func permanent(err error) bool {
+	if mgo.IsDup(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		return e.Code == codeValidation
+	case *mgo.LastError:
+		return e.Code == codeValidation
+	case *mgo.BulkError:
+		for _, c := range e.Cases() {
+			if !permanent(c.Err) {
+				return false
+			}
+		}
+		return len(e.Cases()) > 0
+	}
+	return false
+}
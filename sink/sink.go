@@ -0,0 +1,83 @@
+// Package sink stores documents of ludalo, like samples of the aggregator,
+// independent of the storage, implementations write to MongoDB, to files
+// of JSON lines or keep documents in memory (for tests), and Multi writes
+// to several sinks at once.
+// Documents are maps like bson.M, with values which can be encoded as
+// BSON and JSON.
+package sink
+
+import (
+	"errors"
+	"strings"
+)
+
+// Sink stores documents into collections, implementations are safe for concurrent use
+type Sink interface {
+	// Insert stores documents in collection, documents with an _id which is
+	// already stored are skipped, so documents can be written again
+	Insert(collection string, docs []interface{}) error
+	// Upsert sets fields of the document matching selector in collection,
+	// or inserts a document with fields if there is none
+	Upsert(collection string, selector, fields map[string]interface{}) error
+	// Update sets fields of the document matching selector in collection,
+	// without a matching document nothing is changed
+	Update(collection string, selector, fields map[string]interface{}) error
+	// Remove deletes all documents matching selector in collection, for
+	// retention, sinks keeping an archive ignore it
+	Remove(collection string, selector map[string]interface{}) error
+	// Close writes what is buffered and closes the sink
+	Close() error
+}
+
+// Rejected is returned by sinks for documents the storage did not accept,
+// writing them again fails again, other errors like a lost connection may
+// go away
+type Rejected struct {
+	Err error
+}
+
+func (r *Rejected) Error() string {
+	return "rejected: " + r.Err.Error()
+}
+
+// Multi writes to several sinks, all sinks get all documents, even if one fails
+type Multi []Sink
+
+// Insert stores documents in all sinks
+func (m Multi) Insert(collection string, docs []interface{}) error {
+	return m.each(func(s Sink) error { return s.Insert(collection, docs) })
+}
+
+// Upsert updates documents in all sinks
+func (m Multi) Upsert(collection string, selector, fields map[string]interface{}) error {
+	return m.each(func(s Sink) error { return s.Upsert(collection, selector, fields) })
+}
+
+// Update updates existing documents in all sinks
+func (m Multi) Update(collection string, selector, fields map[string]interface{}) error {
+	return m.each(func(s Sink) error { return s.Update(collection, selector, fields) })
+}
+
+// Remove deletes documents in all sinks
+func (m Multi) Remove(collection string, selector map[string]interface{}) error {
+	return m.each(func(s Sink) error { return s.Remove(collection, selector) })
+}
+
+// Close closes all sinks
+func (m Multi) Close() error {
+	return m.each(func(s Sink) error { return s.Close() })
+}
+
+// call f for all sinks, errors of all sinks are returned as one
+func (m Multi) each(f func(s Sink) error) error {
+	msgs := []string{}
+	for _, s := range m {
+		if err := f(s); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
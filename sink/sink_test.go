@@ -0,0 +1,320 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the latest timestamp marker of the aggregator has to be updated, not appended
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	m.Insert("scratch", []interface{}{bson.M{"ts": 10, "nid": "aggr"}, bson.M{"ts": 10, "nid": "a"}})
+	for ts := 10; ts <= 30; ts += 10 {
+		m.Upsert("latesttimestamp", bson.M{"latestts": bson.M{"$exists": true}}, bson.M{"latestts": ts})
+	}
+	if docs := m.Docs("scratch"); len(docs) != 2 || docs[1].(bson.M)["nid"] != "a" {
+		t.Errorf("documents %v", docs)
+	}
+	latest := m.Docs("latesttimestamp")
+	if len(latest) != 1 || latest[0].(map[string]interface{})["latestts"] != 30 {
+		t.Errorf("latest timestamp %v", latest)
+	}
+	if names := m.Collections(); len(names) != 2 || names[0] != "latesttimestamp" {
+		t.Errorf("collections %v", names)
+	}
+
+	// new documents of upserts get the values of the selector
+	m.Upsert("schema", bson.M{"_id": "ludalo"}, bson.M{"version": 2})
+	if doc := m.Docs("schema")[0].(map[string]interface{}); doc["_id"] != "ludalo" || doc["version"] != 2 {
+		t.Errorf("upserted document %v", doc)
+	}
+
+	// updates change existing documents only
+	m.Update("schema", bson.M{"_id": "ludalo"}, bson.M{"version": 3})
+	m.Update("schema", bson.M{"_id": "other"}, bson.M{"version": 3})
+	if docs := m.Docs("schema"); len(docs) != 1 || docs[0].(map[string]interface{})["version"] != 3 {
+		t.Errorf("documents after update %v", docs)
+	}
+
+	// retention
+	m.Insert("scratch", []interface{}{bson.M{"ts": int64(20), "nid": "aggr"}})
+	m.Remove("scratch", bson.M{"ts": bson.M{"$lt": 15}})
+	if docs := m.Docs("scratch"); len(docs) != 1 || docs[0].(bson.M)["ts"] != int64(20) {
+		t.Errorf("documents after remove %v", docs)
+	}
+}
+
+// files are rotated by size, each line is one complete record
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := NewFile(dir, 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := 0; ts < 10; ts++ {
+		if err := f.Insert("scratch", []interface{}{bson.M{"ts": ts, "v": [4]int64{1 << 40, 2, 3, 4}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Upsert("latesttimestamp", bson.M{"latestts": bson.M{"$exists": true}}, bson.M{"latestts": 9})
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "ludalo-*.jsonl"))
+	if len(files) < 2 {
+		t.Errorf("expected several files, got %v", files)
+	}
+	var inserts, upserts int
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var r struct {
+				Record
+				Doc struct {
+					Ts int
+					V  [4]int64
+				} `json:"doc"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			switch {
+			case r.Op == "insert" && r.Collection == "scratch" && r.Doc.V[0] == 1<<40:
+				inserts++
+			case r.Op == "upsert" && r.Fields["latestts"] == 9.0:
+				upserts++
+			default:
+				t.Errorf("unexpected record %s", scanner.Text())
+			}
+		}
+		file.Close()
+	}
+	if inserts != 10 || upserts != 1 {
+		t.Errorf("found %d inserts and %d upserts", inserts, upserts)
+	}
+}
+
+// all sinks get all documents, even if one fails
+func TestMulti(t *testing.T) {
+	a, b := NewMemory(), NewMemory()
+	// files can not be created below /dev/null
+	multi := Multi{a, &File{dir: os.DevNull}, b}
+	if err := multi.Insert("scratch", []interface{}{bson.M{"ts": 1}}); err == nil {
+		t.Error("error of failing sink not returned")
+	}
+	if len(a.Docs("scratch")) != 1 || len(b.Docs("scratch")) != 1 {
+		t.Errorf("documents %v %v", a.Docs("scratch"), b.Docs("scratch"))
+	}
+}
+
+// a sink which is down until it is set up
+type flaky struct {
+	*Memory
+	lock sync.Mutex
+	up   bool
+}
+
+func (f *flaky) Insert(collection string, docs []interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.up {
+		return errors.New("no reachable servers")
+	}
+	return f.Memory.Insert(collection, docs)
+}
+
+// samples written while the sink is down are replayed in timestamp order,
+// with their types, also by a new spool on the same directory
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	down := &flaky{Memory: NewMemory()}
+	s, err := NewSpool(down, dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []int{20, 10, 30} {
+		if err := s.Insert("scratch", []interface{}{bson.M{"ts": ts, "v": [4]int64{1 << 40}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := s.Stats(); stats.Files != 3 || stats.Pending != 3 || stats.Spooled != 3 {
+		t.Errorf("stats while down %+v", stats)
+	}
+	s.Close()
+
+	// next run, sink is back
+	up := &flaky{Memory: NewMemory(), up: true}
+	s, err = NewSpool(up, dir, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// not written directly, the spool is not empty
+	s.Insert("scratch", []interface{}{bson.M{"ts": 40}})
+	for i := 0; i < 100 && s.Stats().Files > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	docs := up.Docs("scratch")
+	if len(docs) != 4 {
+		t.Fatalf("replayed %v", docs)
+	}
+	for i, d := range docs {
+		doc := d.(bson.M)
+		if doc["ts"] != 10*(i+1) {
+			t.Errorf("document %d has ts %v", i, doc["ts"])
+		}
+		if i < 3 && doc["v"].([]interface{})[0] != int64(1<<40) {
+			t.Errorf("document %d has v %v", i, doc["v"])
+		}
+	}
+	if stats := s.Stats(); stats.Replayed != 4 || stats.Bytes != 0 {
+		t.Errorf("stats after replay %+v", stats)
+	}
+	// directly again
+	s.Insert("scratch", []interface{}{bson.M{"ts": 50}})
+	if len(up.Docs("scratch")) != 5 {
+		t.Errorf("not written directly after replay")
+	}
+}
+
+// sink which writes the first document of the first insert and fails then, like a bulk
+// which was applied partly before the connection was lost
+type partly struct {
+	*Memory
+	lock   sync.Mutex
+	failed bool
+}
+
+func (p *partly) Insert(collection string, docs []interface{}) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.failed {
+		p.failed = true
+		p.Memory.Insert(collection, docs[:1])
+		return errors.New("connection reset by peer")
+	}
+	return p.Memory.Insert(collection, docs)
+}
+
+// a partly written batch is spooled and replayed, documents written before are not stored twice
+func TestSpoolPartly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &partly{Memory: NewMemory()}
+	s, err := NewSpool(p, dir, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	batch := []interface{}{bson.M{"_id": "a:10", "ts": 10}, bson.M{"_id": "b:10", "ts": 10}, bson.M{"_id": "c:10", "ts": 10}}
+	if err := s.Insert("scratch", batch); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && s.Stats().Files > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := s.Stats(); stats.Spooled != 3 || stats.Replayed != 3 || stats.Failed != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	if docs := p.Docs("scratch"); len(docs) != 3 {
+		t.Errorf("documents after replay %v", docs)
+	}
+}
+
+// a full spool drops the oldest files, rejected documents are not spooled
+func TestSpoolLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(&flaky{Memory: NewMemory()}, dir, 300, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for ts := 0; ts < 10; ts++ {
+		if err := s.Insert("scratch", []interface{}{bson.M{"ts": ts}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := s.Stats()
+	if stats.Bytes > 300 || stats.Dropped == 0 || stats.Pending+stats.Dropped != 10 {
+		t.Errorf("stats %+v", stats)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.bson"))
+	if len(files) != stats.Files || !strings.HasPrefix(filepath.Base(files[len(files)-1]), "000000000009-") {
+		t.Errorf("files %v", files)
+	}
+
+	r, err := NewSpool(&rejecting{}, filepath.Join(dir, "r"), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Insert("scratch", []interface{}{bson.M{"ts": 1}}); err == nil || r.Stats().Spooled != 0 {
+		t.Errorf("rejected document spooled, %v", err)
+	}
+}
+
+// only duplicates and invalid documents are rejected by mongo, errors of a failover are spooled
+func TestMongoRejected(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		rejected bool
+	}{
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}, true},
+		{&mgo.QueryError{Code: 121, Message: "Document failed validation"}, true},
+		{&mgo.QueryError{Code: 10107, Message: "not master"}, false},
+		{&mgo.LastError{Code: 91, Err: "shutdown in progress"}, false},
+		{io.EOF, false},
+	} {
+		_, ok := rejected(c.err).(*Rejected)
+		if ok != c.rejected {
+			t.Errorf("%v: rejected is %v", c.err, ok)
+		}
+	}
+	if rejected(nil) != nil {
+		t.Errorf("no error rejected")
+	}
+}
+
+type rejecting struct {
+	Memory
+}
+
+func (*rejecting) Insert(collection string, docs []interface{}) error {
+	return &Rejected{errors.New("bad document")}
+}
@@ -0,0 +1,326 @@
+package sink
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Spool writes to another sink, documents which can not be written are kept
+// in files in a directory and written again later, in the order of their
+// timestamps (field ts of the documents), so the database can be down for a
+// while without losing samples. While there are files in the spool, new
+// documents are spooled as well, so the order is kept and inserters do not
+// wait for a dead database. Documents rejected by the sink are not spooled.
+// Files are BSON, so types like int64 survive, files of an earlier run are
+// replayed as well. If the spool is full, the oldest files are dropped.
+type Spool struct {
+	next    Sink
+	dir     string
+	maxSize int64         // bytes, 0 is unlimited
+	retry   time.Duration // time between attempts to replay
+
+	lock   sync.Mutex
+	files  []spoolFile // sorted by name, oldest first
+	seq    int64       // next sequence number for names
+	lastTs int64       // timestamp of last spooled insert, for upserts
+	stats  SpoolStats
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// SpoolStats are counters of a Spool, documents are counted, an upsert counts as one
+type SpoolStats struct {
+	Files    int   // files in spool
+	Bytes    int64 // size of files in spool
+	Pending  int64 // documents in spool
+	Spooled  int64 // documents written into spool since start
+	Replayed int64 // documents written from spool to sink since start
+	Dropped  int64 // documents dropped as spool was full
+	Failed   int64 // documents in spool which could not be read or were rejected
+}
+
+// file in spool, named timestamp-sequence-documents.bson
+type spoolFile struct {
+	name string
+	size int64
+	docs int
+}
+
+// content of a spool file
+type spoolEntry struct {
+	Op         string        `bson:"op"` // insert, upsert or update
+	Collection string        `bson:"c"`
+	Docs       []interface{} `bson:"docs,omitempty"`
+	Selector   bson.M        `bson:"sel,omitempty"`
+	Fields     bson.M        `bson:"set,omitempty"`
+}
+
+// NewSpool writes to next and spools into directory dir, created if missing,
+// with at most maxSize bytes, replay is tried each retry
+func NewSpool(next Sink, dir string, maxSize int64, retry time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{next: next, dir: dir, maxSize: maxSize, retry: retry,
+		done: make(chan struct{}), stopped: make(chan struct{})}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// incomplete, crashed while writing
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		var ts, seq int64
+		var docs int
+		if _, err := fmt.Sscanf(name, "%d-%d-%d.bson", &ts, &seq, &docs); err != nil || !strings.HasSuffix(name, ".bson") {
+			continue
+		}
+		s.files = append(s.files, spoolFile{name, e.Size(), docs})
+		s.stats.Bytes += e.Size()
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+		if ts > s.lastTs {
+			s.lastTs = ts
+		}
+	}
+	// ReadDir sorts by name
+	if len(s.files) > 0 {
+		log.Print("spool ", dir, " has ", len(s.files), " files of an earlier run")
+	}
+
+	go s.replay()
+	return s, nil
+}
+
+// Insert writes documents to the sink, or into the spool if that fails or
+// the spool is not empty
+func (s *Spool) Insert(collection string, docs []interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	return s.write(spoolEntry{Op: "insert", Collection: collection, Docs: docs}, timestamp(docs[0]), len(docs))
+}
+
+// Upsert writes to the sink like Insert, in order with the inserts before
+func (s *Spool) Upsert(collection string, selector, fields map[string]interface{}) error {
+	return s.write(spoolEntry{Op: "upsert", Collection: collection, Selector: selector, Fields: fields}, -1, 1)
+}
+
+// Update writes to the sink like Upsert
+func (s *Spool) Update(collection string, selector, fields map[string]interface{}) error {
+	return s.write(spoolEntry{Op: "update", Collection: collection, Selector: selector, Fields: fields}, -1, 1)
+}
+
+// Remove deletes documents in the sink, it is not spooled, as a later
+// Remove with the same selector does the same
+func (s *Spool) Remove(collection string, selector map[string]interface{}) error {
+	return s.next.Remove(collection, selector)
+}
+
+// Close stops replaying and closes the sink, the spool stays for the next run
+func (s *Spool) Close() error {
+	close(s.done)
+	<-s.stopped
+	return s.next.Close()
+}
+
+// Stats returns the counters of the spool
+func (s *Spool) Stats() SpoolStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.stats
+	stats.Files = len(s.files)
+	for _, f := range s.files {
+		stats.Pending += int64(f.docs)
+	}
+	return stats
+}
+
+// timestamp of a document, -1 if it has none
+func timestamp(doc interface{}) int64 {
+	m, _ := asMap(doc)
+	switch ts := m["ts"].(type) {
+	case int:
+		return int64(ts)
+	case int32:
+		return int64(ts)
+	case int64:
+		return ts
+	}
+	return -1
+}
+
+func (s *Spool) apply(e spoolEntry) error {
+	switch e.Op {
+	case "upsert":
+		return s.next.Upsert(e.Collection, e.Selector, e.Fields)
+	case "update":
+		return s.next.Update(e.Collection, e.Selector, e.Fields)
+	}
+	return s.next.Insert(e.Collection, e.Docs)
+}
+
+// write e directly if spool is empty, else or if that fails into the spool
+func (s *Spool) write(e spoolEntry, ts int64, docs int) error {
+	s.lock.Lock()
+	empty := len(s.files) == 0
+	s.lock.Unlock()
+	if empty {
+		err := s.apply(e)
+		if _, ok := err.(*Rejected); err == nil || ok {
+			return err
+		}
+		log.Println("WARNING: write error, spooling to", s.dir)
+		log.Println(err)
+	}
+	return s.spool(e, ts, docs)
+}
+
+// write e into a new file of the spool, dropping old files if it is full
+func (s *Spool) spool(e spoolEntry, ts int64, docs int) error {
+	data, err := bson.Marshal(e)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ts < 0 {
+		ts = s.lastTs
+	} else {
+		s.lastTs = ts
+	}
+	if s.maxSize > 0 && size > s.maxSize {
+		s.stats.Dropped += int64(docs)
+		return fmt.Errorf("spool too small for %d bytes", size)
+	}
+	for s.maxSize > 0 && s.stats.Bytes+size > s.maxSize && len(s.files) > 0 {
+		f := s.files[0]
+		log.Println("WARNING: spool full, dropping", f.docs, "documents of", f.name)
+		os.Remove(filepath.Join(s.dir, f.name))
+		s.files = s.files[1:]
+		s.stats.Bytes -= f.size
+		s.stats.Dropped += int64(f.docs)
+	}
+
+	name := fmt.Sprintf("%012d-%09d-%d.bson", ts, s.seq, docs)
+	s.seq++
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := writeSynced(tmp, data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].name > name })
+	s.files = append(s.files, spoolFile{})
+	copy(s.files[i+1:], s.files[i:])
+	s.files[i] = spoolFile{name, size, docs}
+	s.stats.Bytes += size
+	s.stats.Spooled += int64(docs)
+	return nil
+}
+
+// write file and make sure it is on disk before it is renamed
+func writeSynced(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replay files each retry until Close
+func (s *Spool) replay() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(s.retry):
+		}
+		for s.replayOldest() {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// write the oldest file to the sink, false if spool is empty or the sink failed
+func (s *Spool) replayOldest() bool {
+	s.lock.Lock()
+	if len(s.files) == 0 {
+		s.lock.Unlock()
+		return false
+	}
+	f := s.files[0]
+	s.lock.Unlock()
+
+	path := filepath.Join(s.dir, f.name)
+	var e spoolEntry
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = bson.Unmarshal(data, &e)
+	}
+	if err == nil {
+		err = s.apply(e)
+		if _, ok := err.(*Rejected); err != nil && !ok {
+			// still down
+			return false
+		}
+	}
+	if err != nil {
+		log.Println("WARNING: could not replay spool file", f.name+", renamed to", f.name+".bad")
+		log.Println(err)
+		os.Rename(path, path+".bad")
+	} else {
+		os.Remove(path)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.files {
+		if s.files[i].name == f.name {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			s.stats.Bytes -= f.size
+			if err != nil {
+				s.stats.Failed += int64(f.docs)
+			} else {
+				s.stats.Replayed += int64(f.docs)
+			}
+			break
+		}
+	}
+	if len(s.files) == 0 {
+		log.Println("spool", s.dir, "replayed, writing directly again")
+	}
+	return len(s.files) > 0
+}
@@ -7,18 +7,35 @@
 		- after selecting an FS
 			- list OSTs of FS with IO sorted according to BW/s or IOPS/s or META/s
 
+	usage:
+		top [options] [command]
+		top            list OSTs and filesystems
+		top capacity   fill level of OSTs and MDTs per filesystem, imbalanced targets are highlighted
+		top health     state of collectors
+
+		options -cert, -key and -ca give PEM files for TLS, if aggregator uses TLS
+
 */
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/holgerBerger/go_ludalo/lustreserver"
 	"log"
+	"math"
 	"net/rpc"
+	"sort"
 	"strings"
+	"time"
 )
 
 var client *rpc.Client
 
+// targets with a fill level differing more than this (in percent points)
+// from the average of their filesystem are highlighted
+const imbalanceThreshold = 10.0
+
 func ossList(client *rpc.Client) []string {
 	var reply []string
 	err := client.Call("ServerRpcT.OssList", 0, &reply)
@@ -37,21 +54,188 @@ func ostList(client *rpc.Client) []string {
 	return reply
 }
 
+func capacityList(client *rpc.Client) map[string]lustreserver.TargetCapacity {
+	var reply map[string]lustreserver.TargetCapacity
+	err := client.Call("ServerRpcT.Capacity", 0, &reply)
+	if err != nil {
+		log.Panic("rpcerror:", err)
+	}
+	return reply
+}
+
+func healthList(client *rpc.Client) map[string]lustreserver.Health {
+	var reply map[string]lustreserver.Health
+	err := client.Call("ServerRpcT.Health", 0, &reply)
+	if err != nil {
+		log.Panic("rpcerror:", err)
+	}
+	return reply
+}
+
 func fslist() []string {
-	fslist := make([]string, 100)
+	// map as set emulator
+	fsset := make(map[string]struct{})
 	ostlist := ostList(client)
 	for _, v := range ostlist {
-		fslist = append(fslist, strings.Split(v, "-")[0])
+		fsset[strings.Split(v, "-")[0]] = struct{}{}
 	}
+	fslist := make([]string, 0, len(fsset))
+	for fs := range fsset {
+		fslist = append(fslist, fs)
+	}
+	sort.Strings(fslist)
 	return fslist
 }
 
+// percentage of used, 0 for empty total
+func percentUsed(total, free int64) float64 {
+	if total == 0 {
+		return 0.0
+	}
+	return 100.0 * float64(total-free) / float64(total)
+}
+
+// fill level of target t, inodes for MDTs, as they run out of inodes, space for OSTs
+func fillLevel(t string, c lustreserver.TargetCapacity) float64 {
+	if strings.Contains(t, "-MDT") {
+		return percentUsed(c.FilesTotal, c.FilesFree)
+	}
+	return percentUsed(c.KBytesTotal, c.KBytesFree)
+}
+
+// format kbytes human readable
+func formatKB(kb int64) string {
+	units := []string{"KB", "MB", "GB", "TB", "PB"}
+	v := float64(kb)
+	i := 0
+	for v >= 1024.0 && i < len(units)-1 {
+		v /= 1024.0
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+// show fill level of all targets per filesystem, OSTs and MDTs are compared
+// to the average of their kind in the filesystem, as they are filled differently
+func showCapacity() {
+	capacity := capacityList(client)
+
+	// group targets per filesystem
+	fstargets := make(map[string][]string)
+	for t := range capacity {
+		fs := strings.Split(t, "-")[0]
+		fstargets[fs] = append(fstargets[fs], t)
+	}
+	fsnames := make([]string, 0, len(fstargets))
+	for fs := range fstargets {
+		fsnames = append(fsnames, fs)
+	}
+	sort.Strings(fsnames)
+
+	for _, fs := range fsnames {
+		targets := fstargets[fs]
+		sort.Strings(targets)
+
+		// sum of space of OSTs is size of filesystem, sum of inodes of MDTs its number of files
+		var kbtotal, kbfree, ftotal, ffree int64
+		// average fill level of OSTs and MDTs, see fillLevel
+		avg := make(map[bool]float64)
+		count := make(map[bool]int)
+		for _, t := range targets {
+			c := capacity[t]
+			mdt := strings.Contains(t, "-MDT")
+			if mdt {
+				ftotal += c.FilesTotal
+				ffree += c.FilesFree
+			} else {
+				kbtotal += c.KBytesTotal
+				kbfree += c.KBytesFree
+			}
+			avg[mdt] += fillLevel(t, c)
+			count[mdt]++
+		}
+		for mdt := range avg {
+			avg[mdt] /= float64(count[mdt])
+		}
+
+		fmt.Printf("%s: %s of %s used (%.1f%%), %d of %d inodes used (%.1f%%)\n", fs,
+			formatKB(kbtotal-kbfree), formatKB(kbtotal), percentUsed(kbtotal, kbfree),
+			ftotal-ffree, ftotal, percentUsed(ftotal, ffree))
+		fmt.Printf("  %-16s %8s %12s %12s %8s\n", "target", "used", "free", "size", "inodes")
+		for _, t := range targets {
+			c := capacity[t]
+			mdt := strings.Contains(t, "-MDT")
+			line := fmt.Sprintf("  %-16s %7.1f%% %12s %12s %7.1f%%", t, percentUsed(c.KBytesTotal, c.KBytesFree),
+				formatKB(c.KBytesFree), formatKB(c.KBytesTotal), percentUsed(c.FilesTotal, c.FilesFree))
+			if fill := fillLevel(t, c); math.Abs(fill-avg[mdt]) > imbalanceThreshold {
+				// reverse video
+				what := "used"
+				if mdt {
+					what = "inodes"
+				}
+				fmt.Printf("\x1b[7m%s  imbalanced, average %.1f%% %s\x1b[0m\n", line, avg[mdt], what)
+			} else {
+				fmt.Println(line)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// show health of all collectors, one line per server and scan
+func showHealth() {
+	health := healthList(client)
+	servers := make([]string, 0, len(health))
+	for s := range health {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+
+	fmt.Printf("%-16s %-10s %10s %8s %8s %8s %6s %8s %8s %6s\n", "server", "lustre", "uptime", "mem MB",
+		"errors", "scan", "tgts", "exports", "secs", "incompl")
+	for _, s := range servers {
+		h := health[s]
+		line := fmt.Sprintf("%-16s %-10s %10s %8d %8d", s, h.LustreVersion,
+			time.Duration(h.Uptime)*time.Second, h.MemSys/(1024*1024), h.ReadErrors)
+		if h.IsOST {
+			fmt.Printf("%s %8s %6d %8d %8.2f %6v\n", line, "ost", h.OstScan.Targets, h.OstScan.Exports,
+				h.OstScan.Duration, h.OstScan.Incomplete)
+		}
+		if h.IsMDT {
+			fmt.Printf("%s %8s %6d %8d %8.2f %6v\n", line, "mdt", h.MdtScan.Targets, h.MdtScan.Exports,
+				h.MdtScan.Duration, h.MdtScan.Incomplete)
+		}
+		if !h.IsOST && !h.IsMDT {
+			fmt.Printf("%s %8s\n", line, "none")
+		}
+		fmt.Printf("  build %s %s\n", h.BuildID, h.Hash)
+	}
+}
+
 func main() {
+	var tlsConfig lustreserver.TLSConfig
+	flag.StringVar(&tlsConfig.Cert, "cert", "", "certificate in PEM, enables TLS")
+	flag.StringVar(&tlsConfig.Key, "key", "", "private key in PEM")
+	flag.StringVar(&tlsConfig.CA, "ca", "", "CA certificate in PEM, to verify aggregator")
+	flag.Parse()
 
-	client, err := rpc.Dial("tcp", "localhost:2345")
+	config, err := lustreserver.ClientTLS(tlsConfig)
 	if err != nil {
 		log.Panic(err)
 	}
+	client, err = lustreserver.Dial("localhost:2345", config)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if flag.Arg(0) == "capacity" {
+		showCapacity()
+		return
+	}
+	if flag.Arg(0) == "health" {
+		showHealth()
+		return
+	}
 
 	ostlist := ostList(client)
 	fmt.Println(ostlist)
@@ -5,7 +5,8 @@
 # indices used:
 #
 #  use goludalo
-#  db.<fs>.createIndex({"ts":1, "nid":1})
+#  db.<fs>.createIndex({"ts":1, "nid":1})    (created by aggregator, {"ts":1, "n.nid":1} for compact layout)
+#  db.<fs>_1m, <fs>_1h, <fs>_1d              (rollup tiers, same indexes)
 #
 #  use ludalo
 #  db.jobs.createIndex({"start":1}) 
@@ -28,6 +29,15 @@ batchservermap={
 batchskip=True   # set to false if skipping map should not be used
 # END CONFIG
 
+# schema versions of the perf database this script understands, see aggregator/schema.go
+#  1: counters as float (no schema record), 2: counters as int64
+SCHEMAS=(1, 2)
+
+# rollup tiers written by the aggregator, coarsest first, see aggregator/rollup.go
+TIERS=(("1d", 86400), ("1h", 3600), ("1m", 60))
+# newest buckets may not be written yet, they are written after their end
+TIERDELAY=120
+
 import pymongo 
 
 
@@ -79,6 +89,29 @@ class jobstats(object):
 
 
 
+# expand a document of the compact layout into documents of the flat layout,
+# the aggregate of the target with nid "aggr" and one for each nid
+def expandCompact(d):
+    aggr = dict(d)
+    nids = aggr.pop("n", [])
+    aggr["nid"] = "aggr"
+    yield aggr
+    for n in nids:
+        e = dict(n)
+        for k in ("ts", "dt", "ost", "mdt"):
+            if k in d:
+                e[k] = d[k]
+        yield e
+
+# check nid against a nid condition of a flat query, a value or {"$in": list}
+def matchNid(nid, cond):
+    if cond is None:
+        return True
+    if isinstance(cond, dict):
+        return nid in cond.get("$in", [nid])
+    return nid == cond
+
+
 # filesystem object, containing mongo connections
 class filesystem(object):
     def __init__(self, server, fsname):
@@ -88,9 +121,138 @@ class filesystem(object):
         self.perfdb = self.client[PERFDB]
         self.perfcoll = self.perfdb[fsname]
 
+        # schema version of the documents, databases without record have version 1
+        schema = self.perfdb["schema"].find_one({"_id": "ludalo"})
+        self.schema = schema["version"] if schema else 1
+        if self.schema not in SCHEMAS:
+            sys.stderr.write("unknown schema version %d of %s, update top.py\n" % (self.schema, PERFDB))
+        # flat or compact, see findFlat
+        self.layout = schema.get("layout", "flat") if schema else "flat"
+
+        # rollup tiers and their retention in days (0 is forever), see splitRange and pickTier
+        rollup = self.perfdb["rollup"].find_one({"_id": "tiers"})
+        self.tiers = rollup.get("tiers", []) if rollup else []
+        self.retention = rollup.get("retention", {}) if rollup else {}
+        # starts of the aggregator, the last bucket before a start may be incomplete
+        self.starts = [d["start"] for d in self.perfdb["rollup"].find({"start": {"$exists": True}})]
+
         self.jobdb = self.client[JOBDB]
         self.jobcoll = self.jobdb[JOBCOLLECTION]
 
+    # read compatibility for the compact layout: query is written for the flat layout
+    # (a document per target and nid, aggregate of target has nid "aggr"),
+    # and documents are returned in flat layout, for both layouts
+    # coll is the collection to read, default are the samples, tiers have the same layout
+    def findFlat(self, query, coll=None):
+        if coll is None:
+            coll = self.perfcoll
+        if self.layout != "compact":
+            for e in coll.find(query):
+                yield e
+            return
+        # compact documents contain all nids of a target, nid condition is checked
+        # on the expanded documents, and used to select documents containing the nids
+        conds = query["$and"] if "$and" in query else [query]
+        nidcond = None
+        rest = []
+        for c in conds:
+            if "nid" in c:
+                nidcond = c["nid"]
+            else:
+                rest.append(c)
+        if isinstance(nidcond, dict):
+            rest.append({"n.nid": nidcond})
+        for d in coll.find({"$and": rest} if rest else {}):
+            for e in expandCompact(d):
+                if matchNid(e["nid"], nidcond):
+                    yield e
+
+    # collection of a tier, None for the samples
+    def tierColl(self, tier):
+        if tier is None:
+            return self.perfcoll
+        return self.perfdb[self.fsname + "_" + tier]
+
+    # are documents of tier (None for samples) from ts on still there
+    def tierKeeps(self, tier, ts):
+        if tier is not None and tier not in self.tiers:
+            return False
+        days = self.retention.get(tier if tier is not None else "raw", 0)
+        return days <= 0 or ts >= time.time() - days*86400
+
+    # split the range of samples start < ts < end into parts of (collection, condition on ts),
+    # whole buckets of the coarsest tier which has them, the rest from finer tiers and the samples,
+    # so sums over the parts are the sums over the samples
+    def splitRange(self, start, end):
+        return self.splitBuckets(start+1, end, 0)
+
+    # parts of lo <= ts < hi, with tiers from TIERS[i] on
+    def splitBuckets(self, lo, hi, i):
+        if lo >= hi:
+            return []
+        newest = int(time.time()) - TIERDELAY
+        for j in range(i, len(TIERS)):
+            tier, width = TIERS[j]
+            b1 = -(-lo // width) * width
+            b2 = (min(hi, newest) // width) * width
+            if b1 < b2 and self.tierKeeps(tier, b1):
+                return self.splitBuckets(lo, b1, j+1) + \
+                       self.tierParts(j, b1, b2) + \
+                       self.splitBuckets(b2, hi, j+1)
+        return [(self.perfcoll, {"$gte": lo, "$lt": hi})]
+
+    # parts of the buckets b1 <= ts < b2 of TIERS[j], runs of good buckets are read
+    # from the tier, the others from finer tiers and the samples, see goodBuckets
+    def tierParts(self, j, b1, b2):
+        tier, width = TIERS[j]
+        good = self.goodBuckets(tier, b1, b2)
+        parts = []
+        b = b1
+        while b < b2:
+            e = b
+            while e < b2 and e in good:
+                e += width
+            if e > b:
+                parts.append((self.tierColl(tier), {"$gte": b, "$lt": e}))
+            b = e
+            while e < b2 and e not in good:
+                e += width
+            parts += self.splitBuckets(b, e, j+1)
+            b = e
+        return parts
+
+    # buckets of tier with lo <= ts < hi which have all samples: written, and not partial,
+    # the bucket in progress when the aggregator stopped is lost, the bucket before may
+    # miss documents of inserters which did not write it yet, and the first bucket
+    # after a start misses the samples before. buckets without any IO are not written
+    # either, the finer tiers and the samples have nothing for them
+    def goodBuckets(self, tier, lo, hi):
+        coll = self.tierColl(tier)
+        cond = {"ts": {"$gte": lo, "$lt": hi}}
+        written = set(coll.find(cond).distinct("ts"))
+        partial = set(coll.find({"$and": [cond, {"partial": True}]}).distinct("ts"))
+        width = dict(TIERS)[tier]
+        for start in self.starts:
+            first = start - start % width
+            before = [ts for ts in written if ts < first]
+            if before and (first <= hi or coll.find_one({"ts": {"$gte": hi, "$lt": first}}) is None):
+                partial.add(max(before))
+        return written - partial
+
+    # pick one collection for a query of start < ts < end, the samples or the finest tier
+    # giving at most points timestamps, for time series over long ranges
+    def pickTier(self, start, end, points=500):
+        if (end-start)//SNAP <= points and self.tierKeeps(None, start):
+            return self.perfcoll
+        for tier, width in reversed(TIERS):
+            if (end-start)//width <= points and self.tierKeeps(tier, start):
+                return self.tierColl(tier)
+        # coarsest tier we have, or the samples
+        for tier, width in TIERS:
+            if tier in self.tiers:
+                return self.tierColl(tier)
+        return self.perfcoll
+
     # get latest timestamp, searching 5 minutes in the past
     def getLatestTs(self):
         latest=self.perfcoll.find({"ts": {"$gt":getCurrentSnapTime()-300}}).sort("ts",pymongo.DESCENDING)[0][u'ts']
@@ -98,7 +260,7 @@ class filesystem(object):
         
     # get entries for a certain timestamp
     def getEntries(self, timestamp):
-        for p in self.perfcoll.find({"ts":timestamp}):
+        for p in self.findFlat({"ts":timestamp}):
             yield p
 
 
@@ -240,16 +402,18 @@ class filesystem(object):
 
             # print "scanning for",end-start, "sec for",j
 
-            for e in self.perfcoll.find({"$and": [ {"ts": {"$gt": start}}, {"ts": {"$lt": end}}, {"nid": {"$in": jobs[j].nodelist}} ] }):
-                node = e["nid"]
-                if node == "aggr": continue
-                if 'mdt' in e:
-                    jobs[j].miops += e['v']
-                elif 'ost' in e:
-                    jobs[j].wiops += e['v'][0]
-                    jobs[j].wbw   += e['v'][1]
-                    jobs[j].riops += e['v'][2]
-                    jobs[j].rbw   += e['v'][3]
+            # long jobs are read from the rollup tiers
+            for coll, tscond in self.splitRange(start, end):
+                for e in self.findFlat({"$and": [ {"ts": tscond}, {"nid": {"$in": jobs[j].nodelist}} ] }, coll):
+                    node = e["nid"]
+                    if node == "aggr": continue
+                    if 'mdt' in e:
+                        jobs[j].miops += e['v']
+                    elif 'ost' in e:
+                        jobs[j].wiops += e['v'][0]
+                        jobs[j].wbw   += e['v'][1]
+                        jobs[j].riops += e['v'][2]
+                        jobs[j].rbw   += e['v'][3]
             fsjobs.add(j)
 
             # update cache, write cachets, between start and cachets, data was already summed up
@@ -295,25 +459,36 @@ class filesystem(object):
             ) 
         #print r
 
-    # get AGGR values for fs from start to end
+    # get AGGR values for fs from start to end, for long ranges from a rollup tier,
+    # timestamps are the starts of its buckets then, buckets of the tier which can
+    # not be used are summed up from finer tiers and the samples, see goodBuckets
     def getFSvalues(self, start, end):
         timelist = {}
-        for e in self.perfcoll.find({"$and": [ {"ts": {"$gt": start}}, {"ts": {"$lt": end}}, {"nid": "aggr"} ] }):
-            ts = e["ts"]
-            if ts not in timelist:
-                timelist[ts]={}
-                timelist[ts]["miops"] = 0
-                timelist[ts]["wiops"] = 0
-                timelist[ts]["wbw"]   = 0
-                timelist[ts]["riops"] = 0
-                timelist[ts]["rbw"]   = 0
-            if 'mdt' in e:
-                timelist[ts]["miops"] += e['v']
-            elif 'ost' in e:
-                timelist[ts]["wiops"] += e['v'][0]
-                timelist[ts]["wbw"]   += e['v'][1]
-                timelist[ts]["riops"] += e['v'][2]
-                timelist[ts]["rbw"]   += e['v'][3]
+        coll = self.pickTier(start, end)
+        parts = [(coll, {"$gt": start, "$lt": end})]
+        width = 1
+        for j, (tier, w) in enumerate(TIERS):
+            if coll.name == self.tierColl(tier).name:
+                # buckets starting in start < ts < end
+                width = w
+                parts = self.tierParts(j, -(-(start+1) // w) * w, -(-end // w) * w)
+        for coll, tscond in parts:
+            for e in self.findFlat({"$and": [ {"ts": tscond}, {"nid": "aggr"} ] }, coll):
+                ts = e["ts"] - e["ts"] % width
+                if ts not in timelist:
+                    timelist[ts]={}
+                    timelist[ts]["miops"] = 0
+                    timelist[ts]["wiops"] = 0
+                    timelist[ts]["wbw"]   = 0
+                    timelist[ts]["riops"] = 0
+                    timelist[ts]["rbw"]   = 0
+                if 'mdt' in e:
+                    timelist[ts]["miops"] += e['v']
+                elif 'ost' in e:
+                    timelist[ts]["wiops"] += e['v'][0]
+                    timelist[ts]["wbw"]   += e['v'][1]
+                    timelist[ts]["riops"] += e['v'][2]
+                    timelist[ts]["rbw"]   += e['v'][3]
         return timelist
         
 